@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/jobs"
+	"github.com/poriamsz55/distork/api/models/user"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Handler to show what the part janitor removed in its latest runs
+func GetJanitorReports(c echo.Context) error {
+	reports := jobs.JanitorReports()
+
+	var reclaimed int64
+	for _, report := range reports {
+		reclaimed += report.Reclaimed
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"reclaimed": reclaimed,
+		"reports":   reports,
+	})
+}
+
+// Handler to run the part janitor now
+func RunJanitor(c echo.Context) error {
+	return c.JSON(http.StatusOK, jobs.CleanStaleParts(time.Now()))
+}
+
+// Handler to show the drive usage of every user, or of ?username=, as recorded
+// and as measured from the index
+func GetDriveUsage(c echo.Context) error {
+	usage, err := jobs.MeasureUsage(c.QueryParam("username"))
+	if err == mongo.ErrNoDocuments {
+		return c.String(http.StatusNotFound, fmt.Sprintf("User %s not found.", c.QueryParam("username")))
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, usage)
+}
+
+// Handler to show what the quota reconciler corrected in its latest runs
+func GetReconcileReports(c echo.Context) error {
+	return c.JSON(http.StatusOK, jobs.ReconcileReports())
+}
+
+// Handler to run the quota reconciler now
+func ReconcileUsage(c echo.Context) error {
+	return c.JSON(http.StatusOK, jobs.ReconcileQuotas(time.Now()))
+}
+
+// Handler to show the damaged and missing files found by the latest integrity scrubs
+func GetScrubReports(c echo.Context) error {
+	return c.JSON(http.StatusOK, jobs.ScrubReports())
+}
+
+// Handler to read every stored file back and check it against its checksum now.
+// Scrubbing reads the whole storage, it runs in the background and its
+// progress shows in the scrub reports.
+func ScrubStorage(c echo.Context) error {
+	if !jobs.StartScrub(time.Now()) {
+		return c.String(http.StatusConflict, "A scrub is already running.")
+	}
+	return c.JSON(http.StatusAccepted, map[string]string{
+		"message": "Scrub started, its progress shows in the scrub reports.",
+	})
+}
+
+// Handler to show what the latest storage rekeying runs did
+func GetRekeyReports(c echo.Context) error {
+	return c.JSON(http.StatusOK, jobs.RekeyReports())
+}
+
+// Handler to seal every stored file with the current master key, after a key
+// rotation or to encrypt the files stored before encryption was enabled.
+// The whole storage is rewritten, it runs in the background and its progress
+// shows in the rekey reports.
+func RekeyStorage(c echo.Context) error {
+	started, err := jobs.StartRekey(time.Now())
+	if err == jobs.ErrNotEncrypted {
+		return c.String(http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if !started {
+		return c.String(http.StatusConflict, "Storage rekeying is already running.")
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]string{
+		"message": "Storage rekeying started, its progress shows in the rekey reports.",
+	})
+}
+
+// Handler to change the drive size of a user, in bytes. The size stays until
+// it is changed again, the role only decides the size of new users.
+func SetDriveSize(c echo.Context) error {
+	username := c.FormValue("username")
+
+	size, err := strconv.ParseInt(c.FormValue("drive_size"), 10, 64)
+	if err != nil || size < 0 {
+		return c.String(http.StatusBadRequest, "Invalid drive size")
+	}
+
+	err = user.SetDriveSize(username, size)
+	if err == mongo.ErrNoDocuments {
+		return c.String(http.StatusNotFound, fmt.Sprintf("User %s not found.", username))
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to change drive size: %s", err))
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":    fmt.Sprintf("Drive of %s resized.", username),
+		"username":   username,
+		"drive_size": size,
+	})
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/apppass"
+	"github.com/poriamsz55/distork/api/models/user"
+	config "github.com/poriamsz55/distork/configs"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Handler to create an app password, used with the username to mount the drive
+// over WebDAV. The password is only returned by this request.
+func CreateAppPassword(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+	if usr.Role == config.RoleGuest {
+		return c.String(http.StatusForbidden, "Sign up to create app passwords")
+	}
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	if name == "" {
+		return c.String(http.StatusBadRequest, "Give the app password a name")
+	}
+
+	p, secret, err := apppass.NewAppPassword(usr.Username, name)
+	if err != nil {
+		return err
+	}
+	if err := p.AddAppPasswordToDB(); err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to create app password: %s", err))
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":      fmt.Sprintf("App password %s created, it won't be shown again.", name),
+		"app_password": p,
+		"password":     secret,
+	})
+}
+
+// Handler to list the app passwords of the user, without the passwords
+func ListAppPasswords(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+	if usr.Role == config.RoleGuest {
+		return c.String(http.StatusForbidden, "Sign up to use app passwords")
+	}
+
+	passwords, err := apppass.GetAppPasswords(usr.Username)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, passwords)
+}
+
+// Handler to revoke an app password of the user
+func RevokeAppPassword(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+	if usr.Role == config.RoleGuest {
+		return c.String(http.StatusForbidden, "Sign up to use app passwords")
+	}
+
+	err := apppass.DeleteAppPassword(usr.Username, c.QueryParam("id"))
+	if err == mongo.ErrNoDocuments {
+		return c.String(http.StatusNotFound, "App password not found")
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to revoke app password: %s", err))
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "App password revoked.",
+	})
+}
@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/user"
+	"github.com/poriamsz55/distork/storage"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/net/webdav"
+)
+
+// davFS is the drive of a user as a webdav.FileSystem. Entries are read from
+// the index and the storage, and changes go through the same paths as the
+// drive routes: written files are committed like uploads and charged to the
+// drive, deleted entries go to the trash.
+type davFS struct {
+	usr *user.User
+}
+
+// stat returns the index entry of p, the root folder has none so one is made up
+func (d *davFS) stat(p string) (*file.File, error) {
+	if p == "/" {
+		return &file.File{Filename: "/", UUsername: d.usr.Username, Path: "/", Dir: "/", IsDir: true}, nil
+	}
+
+	f, err := file.GetFile(d.usr.Username, p)
+	if err == mongo.ErrNoDocuments {
+		return nil, os.ErrNotExist
+	}
+	return f, err
+}
+
+// checkParent makes sure the folder p is created in exists
+func (d *davFS) checkParent(p string) error {
+	parent, err := d.stat(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	if !parent.IsDir {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	p := utils.CleanDrivePath(name)
+	if _, err := d.stat(p); err == nil {
+		return os.ErrExist
+	}
+	if err := d.checkParent(p); err != nil {
+		return err
+	}
+
+	// Folders only exist in the index until files are stored below them
+	return file.EnsureDirs(d.usr.Username, p)
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	p := utils.CleanDrivePath(name)
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return d.create(p, flag)
+	}
+
+	f, err := d.stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	df := &davFile{usr: d.usr, f: f}
+	if !f.IsDir {
+		df.content = storage.NewReadSeeker(ctx, storage.GetStorage(), f.ContentKey(), f.Size)
+	}
+	return df, nil
+}
+
+// create opens p to be written from the start, the content is committed when it is closed
+func (d *davFS) create(p string, flag int) (webdav.File, error) {
+	if p == "/" {
+		return nil, os.ErrExist
+	}
+
+	existing, err := d.stat(p)
+	if err == nil && (existing.IsDir || flag&os.O_EXCL != 0) {
+		return nil, os.ErrExist
+	}
+	if err != nil && err != os.ErrNotExist {
+		return nil, err
+	}
+	if err == os.ErrNotExist && flag&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	// Files are stored whole, they can't be written in place
+	if err == nil && flag&os.O_TRUNC == 0 {
+		return nil, os.ErrPermission
+	}
+
+	if err := d.checkParent(p); err != nil {
+		return nil, err
+	}
+
+	staged, err := createStaged()
+	if err != nil {
+		return nil, err
+	}
+	return &davWriter{usr: d.usr, path: p, staged: staged}, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	p := utils.CleanDrivePath(name)
+	if p == "/" {
+		return errors.New("The root folder can't be deleted")
+	}
+
+	tree, err := file.GetTree(d.usr.Username, p)
+	if err != nil || len(tree) == 0 {
+		return err
+	}
+
+	// Deleted entries go to the trash, like with the drive routes
+	_, err = trashTree(ctx, d.usr, p, tree)
+	return err
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	src := utils.CleanDrivePath(oldName)
+	dst := utils.CleanDrivePath(newName)
+	if dst == "/" {
+		return os.ErrExist
+	}
+
+	if _, status, err := checkTransfer(d.usr, src, path.Dir(dst)); status == http.StatusNotFound {
+		return os.ErrNotExist
+	} else if err != nil {
+		return err
+	}
+	if _, err := d.stat(dst); err == nil {
+		return os.ErrExist
+	}
+
+	return moveTree(ctx, d.usr, src, dst)
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	f, err := d.stat(utils.CleanDrivePath(name))
+	if err != nil {
+		return nil, err
+	}
+	return davInfo{f}, nil
+}
+
+// davInfo describes an index entry, with the media type and ETag of the
+// drive routes so WebDAV doesn't read files to find them
+type davInfo struct {
+	f *file.File
+}
+
+func (i davInfo) Name() string       { return i.f.Filename }
+func (i davInfo) Size() int64        { return i.f.Size }
+func (i davInfo) ModTime() time.Time { return i.f.ModTime }
+func (i davInfo) IsDir() bool        { return i.f.IsDir }
+func (i davInfo) Sys() any           { return nil }
+
+func (i davInfo) Mode() fs.FileMode {
+	if i.f.IsDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i davInfo) ContentType(ctx context.Context) (string, error) {
+	return i.f.ContentType(), nil
+}
+
+func (i davInfo) ETag(ctx context.Context) (string, error) {
+	if i.f.Hash != "" {
+		return hashETag(i.f.Hash), nil
+	}
+	return fileETag(i.f.Size, i.f.ModTime), nil
+}
+
+// davFile is a folder or a file opened for reading
+type davFile struct {
+	usr      *user.User
+	f        *file.File
+	content  *storage.ReadSeeker // nil for folders
+	children []file.File         // entries Readdir didn't return yet
+	listed   bool
+}
+
+func (df *davFile) Read(p []byte) (int, error) {
+	if df.content == nil {
+		return 0, os.ErrInvalid
+	}
+	return df.content.Read(p)
+}
+
+func (df *davFile) Seek(offset int64, whence int) (int64, error) {
+	if df.content == nil {
+		return 0, os.ErrInvalid
+	}
+	return df.content.Seek(offset, whence)
+}
+
+func (df *davFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (df *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if !df.f.IsDir {
+		return nil, os.ErrInvalid
+	}
+
+	if !df.listed {
+		children, err := file.GetFilesByDir(df.usr.Username, df.f.Path)
+		if err != nil {
+			return nil, err
+		}
+		df.children = children
+		df.listed = true
+	}
+
+	n := len(df.children)
+	if count > 0 {
+		if n == 0 {
+			return nil, io.EOF
+		}
+		n = min(n, count)
+	}
+
+	infos := make([]fs.FileInfo, 0, n)
+	for i := range df.children[:n] {
+		infos = append(infos, davInfo{&df.children[i]})
+	}
+	df.children = df.children[n:]
+	return infos, nil
+}
+
+func (df *davFile) Stat() (fs.FileInfo, error) {
+	return davInfo{df.f}, nil
+}
+
+func (df *davFile) Close() error {
+	if df.content != nil {
+		return df.content.Close()
+	}
+	return nil
+}
+
+// davWriter stages a file being written and commits it like an upload
+// when it is closed. Writes stop as soon as the drive is full.
+type davWriter struct {
+	usr     *user.User
+	path    string
+	staged  *os.File
+	written int64
+	err     error
+	closed  bool
+}
+
+func (w *davWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if w.usr.DriveUsed+w.written+int64(len(p)) > w.usr.DriveSize {
+		w.err = errInsufficientSpace
+		return 0, w.err
+	}
+
+	n, err := w.staged.Write(p)
+	w.written += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *davWriter) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (w *davWriter) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (w *davWriter) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (w *davWriter) Stat() (fs.FileInfo, error) {
+	return davInfo{file.NewFile(w.usr.Username, w.path, w.written, time.Now(), false)}, nil
+}
+
+// Close stores what was written, an existing file is kept as a version
+func (w *davWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer os.Remove(w.staged.Name())
+
+	if err := w.staged.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	_, err := commitUpload(w.usr, path.Dir(w.path), path.Base(w.path), w.staged.Name(), true, 0)
+	return err
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/user"
+	"golang.org/x/net/webdav"
+)
+
+// davLocks holds the WebDAV locks of every user. Lock names are paths inside
+// a drive, so each user gets a lock system of their own.
+var davLocks = struct {
+	sync.Mutex
+	systems map[string]webdav.LockSystem
+}{systems: map[string]webdav.LockSystem{}}
+
+func davLockSystem(username string) webdav.LockSystem {
+	davLocks.Lock()
+	defer davLocks.Unlock()
+
+	ls, ok := davLocks.systems[username]
+	if !ok {
+		ls = webdav.NewMemLS()
+		davLocks.systems[username] = ls
+	}
+	return ls
+}
+
+// Handler serving the user's drive over WebDAV, to mount it in file managers
+// or sync it with tools like rclone
+func DAV(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	// Refuse uploads that can't fit before reading them, writes are checked
+	// again as they arrive when the client doesn't send the length
+	if c.Request().Method == http.MethodPut && c.Request().ContentLength > usr.DriveSize-usr.DriveUsed {
+		return c.String(http.StatusInsufficientStorage, errInsufficientSpace.Error())
+	}
+
+	h := &webdav.Handler{
+		// The route is the group path with a wildcard, e.g. /api/dav/*
+		Prefix:     strings.TrimSuffix(c.Path(), "/*"),
+		FileSystem: &davFS{usr: usr},
+		LockSystem: davLockSystem(usr.Username),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("WebDAV %s %s for %s failed: %s", r.Method, r.URL.Path, usr.Username, err)
+			}
+		},
+	}
+	h.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"os"
+	"testing"
+
+	"github.com/poriamsz55/distork/api/models/user"
+)
+
+func Test_davWriter(t *testing.T) {
+	staged, err := os.CreateTemp(t.TempDir(), "upload-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staged.Close()
+
+	usr := &user.User{Username: "alice", DriveSize: 10, DriveUsed: 4}
+	w := &davWriter{usr: usr, path: "/a.txt", staged: staged}
+
+	if n, err := w.Write([]byte("0123")); n != 4 || err != nil {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	if info, _ := w.Stat(); info.Size() != 4 || info.Name() != "a.txt" {
+		t.Errorf("Stat() = %s %d bytes", info.Name(), info.Size())
+	}
+
+	// 4 used, 4 written and 3 more don't fit in 10
+	if _, err := w.Write([]byte("456")); err != errInsufficientSpace {
+		t.Fatalf("Write() over the quota error = %v", err)
+	}
+	// The file is never committed once a write failed
+	if err := w.Close(); err != errInsufficientSpace {
+		t.Errorf("Close() error = %v", err)
+	}
+	if _, err := os.Stat(staged.Name()); !os.IsNotExist(err) {
+		t.Errorf("staged file left behind: %v", err)
+	}
+}
+
+func Test_davLockSystem(t *testing.T) {
+	if davLockSystem("alice") != davLockSystem("alice") {
+		t.Error("a user got two lock systems")
+	}
+	if davLockSystem("alice") == davLockSystem("bob") {
+		t.Error("two users share a lock system")
+	}
+}
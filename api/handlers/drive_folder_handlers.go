@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/blob"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/grant"
+	"github.com/poriamsz55/distork/api/models/share"
+	"github.com/poriamsz55/distork/api/models/user"
+	"github.com/poriamsz55/distork/api/models/version"
+	"github.com/poriamsz55/distork/storage"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Handler to create a new folder inside the user's drive
+func CreateFolder(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	currentPath := utils.CleanDrivePath(c.QueryParam("path"))
+	name := c.FormValue("name")
+	if !validName(name) {
+		return c.String(http.StatusBadRequest, "Invalid folder name")
+	}
+
+	usr, status, err := driveOwner(c, usr, currentPath, grant.RoleEditor)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	if currentPath != "/" {
+		parent, err := file.GetFile(usr.Username, currentPath)
+		if err != nil || !parent.IsDir {
+			return c.String(http.StatusNotFound, "Directory does not exist")
+		}
+	}
+
+	folderPath := path.Join(currentPath, name)
+	if _, err := file.GetFile(usr.Username, folderPath); err == nil {
+		return c.String(http.StatusConflict, fmt.Sprintf("%s already exists", name))
+	}
+
+	// Folders only exist in the index until files are stored below them
+	if err := file.EnsureDirs(usr.Username, folderPath); err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to index folder: %s", err))
+	}
+
+	return c.JSON(http.StatusCreated, file.NewFile(usr.Username, folderPath, 0, time.Now(), true))
+}
+
+// Handler to rename a file or folder in place
+func RenameFile(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	srcPath := utils.CleanDrivePath(c.QueryParam("path"))
+	name := c.FormValue("name")
+	if !validName(name) {
+		return c.String(http.StatusBadRequest, "Invalid name")
+	}
+
+	usr, status, err := driveOwner(c, usr, srcPath, grant.RoleEditor)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	return moveFile(c, usr, srcPath, path.Join(path.Dir(srcPath), name))
+}
+
+// Handler to move a file or folder into another folder
+func MoveFile(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	srcPath := utils.CleanDrivePath(c.QueryParam("path"))
+	destDir := utils.CleanDrivePath(c.FormValue("dest"))
+
+	// Both ends must be editable, files never move between drives
+	owner, status, err := driveOwner(c, usr, srcPath, grant.RoleEditor)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+	if _, status, err := driveOwner(c, usr, destDir, grant.RoleEditor); err != nil {
+		return c.String(status, err.Error())
+	}
+
+	return moveFile(c, owner, srcPath, path.Join(destDir, path.Base(srcPath)))
+}
+
+// Handler to copy a file or folder into another folder
+func CopyFile(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	srcPath := utils.CleanDrivePath(c.QueryParam("path"))
+	destDir := utils.CleanDrivePath(c.FormValue("dest"))
+
+	// Copies stay in the owner's drive and count against the owner's quota
+	if _, status, err := driveOwner(c, usr, srcPath, grant.RoleViewer); err != nil {
+		return c.String(status, err.Error())
+	}
+	usr, status, err := driveOwner(c, usr, destDir, grant.RoleEditor)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	tree, status, err := checkTransfer(usr, srcPath, destDir)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	// Pick a free name in the destination, the same way uploads do
+	var dstPath string
+	copyCount := 0
+	for {
+		dstPath = path.Join(destDir, utils.SanitizeFileName(path.Base(srcPath), copyCount))
+		if _, err := file.GetFile(usr.Username, dstPath); err == nil {
+			copyCount++
+		} else {
+			break
+		}
+	}
+
+	// Copies count against the user's drive, the space is reserved before
+	// anything is copied and given back if the copy fails
+	copySize := file.TreeSize(tree)
+	done := user.BeginDriveChange(usr.Username)
+	defer done()
+
+	err = reserveSpace(usr, copySize)
+	if err == errInsufficientSpace {
+		return c.String(http.StatusForbidden, err.Error())
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to update drive usage: %s", err))
+	}
+
+	// A failed copy is undone, the references and entries already added
+	// are dropped and the reservation is given back
+	var refs []string
+	undo := func() {
+		for _, hash := range refs {
+			blob.Release(hash)
+		}
+		file.DeleteFileFromDB(usr.Username, dstPath)
+		storage.GetStorage().Delete(context.Background(), utils.DriveKey(usr.Username, dstPath))
+		releaseSpace(usr, copySize)
+	}
+
+	// Only files stored before deduplication have content to copy,
+	// the copies of the others refer to the same blobs
+	_, err = storage.Copy(c.Request().Context(), storage.GetStorage(),
+		utils.DriveKey(usr.Username, srcPath), utils.DriveKey(usr.Username, dstPath))
+	if err != nil {
+		undo()
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to copy: %s", err))
+	}
+
+	// Index the copied entries under their new paths
+	if err := file.EnsureDirs(usr.Username, destDir); err != nil {
+		undo()
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to index copy: %s", err))
+	}
+	now := time.Now()
+	for _, f := range tree {
+		copied := file.NewFile(usr.Username, dstPath+strings.TrimPrefix(f.Path, srcPath), f.Size, now, f.IsDir)
+		copied.Hash = f.Hash
+		copied.MimeType = f.MimeType
+		if f.Hash != "" {
+			if err := blob.AddRef(f.Hash); err != nil {
+				undo()
+				return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to copy %s: %s", f.Path, err))
+			}
+			refs = append(refs, f.Hash)
+		}
+		if err := copied.AddFileToDB(); err != nil {
+			undo()
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to index copy: %s", err))
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("%s copied successfully.", path.Base(srcPath)),
+		"path":    dstPath,
+	})
+}
+
+// moveFile renames srcPath to dstPath on disk and in the index
+func moveFile(c echo.Context, usr *user.User, srcPath, dstPath string) error {
+	if _, status, err := checkTransfer(usr, srcPath, path.Dir(dstPath)); err != nil {
+		return c.String(status, err.Error())
+	}
+
+	if srcPath == dstPath {
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": "Nothing to move.",
+			"path":    dstPath,
+		})
+	}
+
+	if _, err := file.GetFile(usr.Username, dstPath); err == nil {
+		return c.String(http.StatusConflict, fmt.Sprintf("%s already exists", dstPath))
+	}
+
+	if err := moveTree(c.Request().Context(), usr, srcPath, dstPath); err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("%s moved successfully.", path.Base(srcPath)),
+		"path":    dstPath,
+	})
+}
+
+// moveTree moves srcPath and its tree to dstPath in the storage and the index,
+// with the versions, share links and grants of the moved entries
+func moveTree(ctx context.Context, usr *user.User, srcPath, dstPath string) error {
+	// Empty folders only exist in the index, there is nothing to move for them
+	err := storage.GetStorage().Move(ctx,
+		utils.DriveKey(usr.Username, srcPath), utils.DriveKey(usr.Username, dstPath))
+	if err != nil && err != storage.ErrNotExist {
+		return fmt.Errorf("Failed to move: %s", err)
+	}
+
+	if err := file.MoveTree(usr.Username, srcPath, dstPath); err != nil {
+		return fmt.Errorf("Failed to update index: %s", err)
+	}
+
+	if err := version.MoveVersions(usr.Username, srcPath, dstPath); err != nil {
+		return fmt.Errorf("Failed to update versions: %s", err)
+	}
+
+	// Share links and grants follow what they point at
+	if err := share.MoveShares(usr.Username, srcPath, dstPath); err != nil {
+		return fmt.Errorf("Failed to update shares: %s", err)
+	}
+	if err := grant.MoveGrants(usr.Username, srcPath, dstPath); err != nil {
+		return fmt.Errorf("Failed to update grants: %s", err)
+	}
+	return nil
+}
+
+// checkTransfer validates the source and destination of a move or copy and
+// returns the source tree. The status is the HTTP code to answer with on error.
+func checkTransfer(usr *user.User, srcPath, destDir string) ([]file.File, int, error) {
+	if srcPath == "/" {
+		return nil, http.StatusBadRequest, fmt.Errorf("The root folder can't be moved or copied")
+	}
+
+	// A folder can't end up inside itself
+	if destDir == srcPath || strings.HasPrefix(destDir, srcPath+"/") {
+		return nil, http.StatusBadRequest, fmt.Errorf("Can't move a folder into itself")
+	}
+
+	if destDir != "/" {
+		dest, err := file.GetFile(usr.Username, destDir)
+		if err != nil || !dest.IsDir {
+			return nil, http.StatusNotFound, fmt.Errorf("Destination folder does not exist")
+		}
+	}
+
+	tree, err := file.GetTree(usr.Username, srcPath)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, http.StatusInternalServerError, err
+	}
+	if len(tree) == 0 {
+		return nil, http.StatusNotFound, fmt.Errorf("%s not found", srcPath)
+	}
+
+	return tree, http.StatusOK, nil
+}
+
+// validName reports whether name can be used as a single path element
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
@@ -2,23 +2,35 @@ package handlers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
-	"sort"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/blob"
 	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/grant"
+	"github.com/poriamsz55/distork/api/models/share"
+	"github.com/poriamsz55/distork/api/models/trash"
 	"github.com/poriamsz55/distork/api/models/user"
+	"github.com/poriamsz55/distork/api/models/version"
 	config "github.com/poriamsz55/distork/configs"
-	"github.com/poriamsz55/distork/database"
+	"github.com/poriamsz55/distork/storage"
 	"github.com/poriamsz55/distork/utils"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
 // Handler to upload files using streaming
@@ -31,6 +43,13 @@ func UploadFile(c echo.Context) error {
 		currentPath = "." // Default to root if no path is provided
 	}
 
+	// Uploads into a folder shared by another user go to the
+	// owner's drive and count against the owner's quota
+	usr, status, err := driveOwner(c, usr, currentPath, grant.RoleEditor)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
 	// Get form file
 	file, err := c.FormFile("file")
 	if err != nil {
@@ -52,63 +71,65 @@ func UploadFile(c echo.Context) error {
 	}
 	defer src.Close()
 
-	// Create user-specific directory if not exists
-	userDir := filepath.Join(config.GetConfigDrive().UploadDir, usr.Username, currentPath)
-	if err := os.MkdirAll(userDir, os.ModePerm); err != nil {
-		return err
-	}
-
-	// Create destination file
-	var dstPath string
-	var copyCount int = 0
-	for {
-		dstPath = filepath.Join(userDir, utils.SanitizeFileName(file.Filename, copyCount))
-		// Rename the destination file if it exists
-		if _, err := os.Stat(dstPath); err == nil {
-			copyCount++
-		} else {
-			break
-		}
-	}
-
-	dst, err := os.Create(dstPath)
+	// Stage the upload on local disk, it is hashed before it is stored
+	staged, err := stageUpload(src)
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
+	defer os.Remove(staged)
 
-	// Stream the uploaded file to the destination
-	if _, err = io.Copy(dst, src); err != nil {
-		return err
+	// Archives can be extracted into the folder instead of being stored
+	if c.QueryParam("extract") == "1" {
+		return extractUpload(c, usr, currentPath, staged, file.Filename)
 	}
 
-	collection := database.Collection(config.GetConfigDB().UserColl)
-
-	// Update DriveUsed for the user
-	usr.DriveUsed = newDriveUsed
-	_, err = collection.UpdateOne(
-		context.Background(),
-		bson.M{"username": usr.Username},
-		bson.M{"$set": bson.M{"drive_used": usr.DriveUsed}},
-	)
+	// In version mode an existing file with the same
+	// name is kept as a version instead of renaming
+	keepVersions := c.QueryParam("mode") == "version"
+	_, err = commitUpload(usr, currentPath, file.Filename, staged, keepVersions, 0)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to update drive usage: %s", err))
+		return uploadError(c, err)
 	}
 
 	return c.String(http.StatusOK, fmt.Sprintf("File %s uploaded successfully.", file.Filename))
 }
 
+// chunkTimestampPattern is what a chunked upload may send as its timestamp,
+// it is part of the name of the parts on disk
+var chunkTimestampPattern = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
+
 func UploadFileChunk(c echo.Context) error {
 	usr := c.Get("user").(*user.User)
 
-	// Get chunk details
-	chunkNumber := c.FormValue("chunkNumber") // The index of the current chunk
-	totalChunks := c.FormValue("totalChunks") // Total number of chunks
-	fileName := c.FormValue("fileName")       // The original file name
-	timestamp := c.FormValue("timestamp")     // Timestamp from the client
+	// Get chunk details, they name the parts on disk
+	currentChunk, err := strconv.Atoi(c.FormValue("chunkNumber")) // The index of the current chunk
+	if err != nil || currentChunk < 0 {
+		return c.String(http.StatusBadRequest, "Invalid chunkNumber")
+	}
+	total, err := strconv.Atoi(c.FormValue("totalChunks")) // Total number of chunks
+	if err != nil || total <= currentChunk {
+		return c.String(http.StatusBadRequest, "Invalid totalChunks")
+	}
+	fileName := c.FormValue("fileName")   // The original file name
+	timestamp := c.FormValue("timestamp") // Timestamp from the client
 	if timestamp == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "Missing timestamp")
 	}
+	if !chunkTimestampPattern.MatchString(timestamp) {
+		return c.String(http.StatusBadRequest, "Invalid timestamp")
+	}
+
+	currentPath := c.QueryParam("path")
+	if currentPath == "" {
+		currentPath = "." // Default to root if no path is provided
+	}
+
+	// Uploads into a folder shared by another user go to the
+	// owner's drive and count against the owner's quota
+	usr, status, err := driveOwner(c, usr, currentPath, grant.RoleEditor)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
 
 	chunkFile, err := c.FormFile("file")
 	if err != nil {
@@ -124,14 +145,10 @@ func UploadFileChunk(c echo.Context) error {
 		return c.String(http.StatusForbidden, "Insufficient drive space.")
 	}
 
-	currentPath := c.QueryParam("path")
-	if currentPath == "" {
-		currentPath = "." // Default to root if no path is provided
-	}
-
-	// Create user-specific directory if not exists
-	userDir := filepath.Join(config.GetConfigDrive().UploadDir, usr.Username, currentPath)
-	if err := os.MkdirAll(userDir, os.ModePerm); err != nil {
+	// Parts are staged on local disk until the last one arrives
+	currentPath = utils.CleanDrivePath(currentPath)
+	partDir := filepath.Join(config.GetConfigDrive().PartDir, usr.Username, filepath.FromSlash(currentPath))
+	if err := os.MkdirAll(partDir, os.ModePerm); err != nil {
 		return err
 	}
 
@@ -143,8 +160,8 @@ func UploadFileChunk(c echo.Context) error {
 	defer src.Close()
 
 	// Save the chunk with a name including the timestamp
-	chunkFileName := fmt.Sprintf("%s.part-%s-%s", utils.SanitizeFileName(fileName, 0), chunkNumber, timestamp)
-	chunkPath := filepath.Join(userDir, chunkFileName)
+	chunkFileName := fmt.Sprintf("%s.part-%d-%s", utils.SanitizeFileName(fileName, 0), currentChunk, timestamp)
+	chunkPath := filepath.Join(partDir, chunkFileName)
 	dst, err := os.Create(chunkPath)
 	if err != nil {
 		return err
@@ -157,61 +174,44 @@ func UploadFileChunk(c echo.Context) error {
 	}
 
 	// Check if all chunks are uploaded
-	currentChunk, _ := strconv.Atoi(chunkNumber)
-	total, _ := strconv.Atoi(totalChunks)
-
 	if currentChunk == total-1 {
 		// Once all chunks are uploaded, combine them into the final file
-
-		// Determine the final file name, handling duplicates
-		var finalFileName string
-		var copyCount int = 0
-		for {
-			finalFileName = utils.SanitizeFileName(fileName, copyCount)
-			finalDstPath := filepath.Join(userDir, finalFileName)
-			if _, err := os.Stat(finalDstPath); err == nil {
-				// File exists, increment copy count
-				copyCount++
-			} else {
-				// File does not exist, break the loop
-				break
-			}
-		}
-
-		finalDstPath := filepath.Join(userDir, finalFileName)
-		dst, err := os.Create(finalDstPath)
+		assembled, err := os.CreateTemp(partDir, "assembled-*")
 		if err != nil {
 			return err
 		}
-		defer dst.Close()
+		defer os.Remove(assembled.Name())
+		defer assembled.Close()
 
 		// Combine all the chunks
 		for i := 0; i < total; i++ {
 			chunkFileName := fmt.Sprintf("%s.part-%d-%s", utils.SanitizeFileName(fileName, 0), i, timestamp)
-			chunkPath := filepath.Join(userDir, chunkFileName)
+			chunkPath := filepath.Join(partDir, chunkFileName)
 			part, err := os.Open(chunkPath)
 			if err != nil {
 				return err
 			}
-			if _, err := io.Copy(dst, part); err != nil {
-				part.Close()
+			_, err = io.Copy(assembled, part)
+			part.Close()
+			if err != nil {
 				return err
 			}
-			part.Close()
 			os.Remove(chunkPath) // Remove the chunk files after combining
 		}
+		if err := assembled.Close(); err != nil {
+			return err
+		}
 
-		collection := database.Collection(config.GetConfigDB().UserColl)
+		// Archives can be extracted into the folder instead of being stored
+		if c.QueryParam("extract") == "1" {
+			return extractUpload(c, usr, currentPath, assembled.Name(), fileName)
+		}
 
-		// Update DriveUsed for the user after final file creation
-		usr.DriveUsed = newDriveUsed
-		_, err = collection.UpdateOne(
-			context.Background(),
-			bson.M{"username": usr.Username},
-			bson.M{"$set": bson.M{"drive_used": usr.DriveUsed}},
-		)
+		// Determine the final file name, handling duplicates or versions
+		keepVersions := c.QueryParam("mode") == "version"
+		finalFileName, err := commitUpload(usr, currentPath, fileName, assembled.Name(), keepVersions, 0)
 		if err != nil {
-			return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to update drive usage: %s", err))
+			return uploadError(c, err)
 		}
 
 		// Optionally, you can inform the user about the final file name
@@ -224,67 +224,319 @@ func UploadFileChunk(c echo.Context) error {
 	return c.String(http.StatusOK, fmt.Sprintf("Chunk %d uploaded successfully.", currentChunk))
 }
 
-// Handler to list files and folders for a specific user
+// FileList is one page of a folder listing
+type FileList struct {
+	Items      []file.File `json:"items"`
+	Total      int64       `json:"total"`   // entries in the folder
+	Folders    int64       `json:"folders"` // folders among them
+	Files      int64       `json:"files"`
+	NextCursor string      `json:"next_cursor,omitempty"` // cursor of the next page, empty on the last one
+}
+
+// Handler to list files and folders for a specific user. The page is chosen with
+// sort=name|size|type|mtime, order=asc|desc, folders_first=1, limit and cursor.
+// By default the most recent entries come first.
 func ListFilesAndFolders(c echo.Context) error {
 	usr := c.Get("user").(*user.User) // Get the authenticated user
 
+	listing, err := parseListing(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
 	// Get the current path from the query parameter
 	currentPath := c.QueryParam("path")
 	if currentPath == "" {
 		currentPath = "." // Default to root if no path is provided
 	}
+	currentPath = utils.CleanDrivePath(currentPath)
 
-	uploadPath := ""
-	uploadBase := ""
-	if usr.Role == config.RoleAdmin {
-		uploadPath = filepath.Join(config.GetConfigDrive().UploadDir, currentPath)
-		uploadBase = config.GetConfigDrive().UploadDir
-	} else {
-		uploadPath = filepath.Join(config.GetConfigDrive().UploadDir, usr.Username, currentPath)
-		uploadBase = filepath.Join(config.GetConfigDrive().UploadDir, usr.Username)
+	// Folders shared by another user are browsed with ?owner=
+	drive, status, err := driveOwner(c, usr, currentPath, grant.RoleViewer)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	// Admins browse the whole upload directory, the first
+	// element of the path is the owner of the drive
+	owner := drive.Username
+	if drive == usr && usr.Role == config.RoleAdmin {
+		if currentPath == "/" {
+			return listDriveOwners(c)
+		}
+		parts := strings.SplitN(strings.TrimPrefix(currentPath, "/"), "/", 2)
+		owner = parts[0]
+		currentPath = "/"
+		if len(parts) == 2 {
+			currentPath = utils.CleanDrivePath(parts[1])
+		}
 	}
 
 	// Ensure the directory exists
-	if _, err := os.Stat(uploadPath); os.IsNotExist(err) {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"message": "Directory does not exist",
-		})
+	if currentPath != "/" {
+		dir, err := file.GetFile(owner, currentPath)
+		if err != nil || !dir.IsDir {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Directory does not exist",
+			})
+		}
 	}
 
-	// Read the directory and return the list of files and folders
-	fileList := []file.File{}
-	entries, err := os.ReadDir(uploadPath) // Read the directory contents
+	page, err := file.ListDir(owner, currentPath, listing)
+	if err == file.ErrInvalidCursor {
+		return c.String(http.StatusBadRequest, "Invalid cursor, list the folder again from the first page")
+	}
 	if err != nil {
 		return err
 	}
 
-	for _, entry := range entries {
-		info, err := entry.Info() // Get file information
+	// Thumbnails of another user's images are requested with the same ?owner=
+	if owner == drive.Username {
+		if drive == usr {
+			addThumbnailURLs(page.Files, "")
+		} else {
+			addThumbnailURLs(page.Files, owner)
+		}
+	}
+
+	return jsonWithETag(c, FileList{
+		Items:      page.Files,
+		Total:      page.Total,
+		Folders:    page.Folders,
+		Files:      page.Total - page.Folders,
+		NextCursor: page.NextCursor,
+	})
+}
+
+// parseListing reads the order and page of a folder listing from the query.
+// Names and types are listed in ascending order by default, sizes and
+// modification times in descending order.
+func parseListing(c echo.Context) (*file.Listing, error) {
+	drive := config.GetConfigDrive()
+	l := &file.Listing{
+		Sort:   c.QueryParam("sort"),
+		Cursor: c.QueryParam("cursor"),
+		Limit:  drive.ListPageSize,
+	}
+
+	if l.Sort == "" {
+		l.Sort = "mtime"
+	}
+	if _, ok := file.ListSorts[l.Sort]; !ok {
+		return nil, fmt.Errorf("Invalid sort %q, use name, size, type or mtime", l.Sort)
+	}
+
+	switch c.QueryParam("order") {
+	case "":
+		l.Desc = l.Sort == "size" || l.Sort == "mtime"
+	case "asc":
+	case "desc":
+		l.Desc = true
+	default:
+		return nil, fmt.Errorf("Invalid order %q, use asc or desc", c.QueryParam("order"))
+	}
+
+	if value := c.QueryParam("folders_first"); value != "" {
+		foldersFirst, err := strconv.ParseBool(value)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("Invalid folders_first %q", value)
 		}
+		l.FoldersFirst = foldersFirst
+	}
 
-		// TODO: use info.Name() for Filename
+	if value := c.QueryParam("limit"); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("Invalid limit %q", value)
+		}
+		l.Limit = min(limit, drive.ListMaxPageSize)
+	}
+
+	return l, nil
+}
+
+// listDriveOwners shows every drive as a folder at the admin's root
+func listDriveOwners(c echo.Context) error {
+	owners, err := file.GetOwners()
+	if err != nil {
+		return err
+	}
+
+	fileList := []file.File{}
+	for _, owner := range owners {
 		fileList = append(fileList, file.File{
-			Filename:  info.Name(),
-			UUsername: usr.Username,
-			IsDir:     info.IsDir(),
-			Path:      strings.TrimPrefix(filepath.Join(uploadBase, info.Name()), uploadBase), // Trim the base path for relative paths
-			Size:      info.Size(),
-			ModTime:   info.ModTime(),
+			Filename:  owner,
+			UUsername: owner,
+			IsDir:     true,
+			Path:      "/" + owner,
+			Dir:       "/",
 		})
 	}
 
-	// Sort files by modification time (most recent first)
-	sort.Slice(fileList, func(i, j int) bool {
-		return fileList[i].ModTime.After(fileList[j].ModTime)
+	return jsonWithETag(c, FileList{
+		Items:   fileList,
+		Total:   int64(len(fileList)),
+		Folders: int64(len(fileList)),
 	})
+}
+
+// errInsufficientSpace is returned when a file doesn't fit in the user's drive
+var errInsufficientSpace = errors.New("Insufficient drive space.")
+
+// reserveSpace charges size bytes to the user's drive if they fit. The check
+// and the charge are a single update, the usage read when the request was
+// authenticated may already be stale when parallel uploads land together.
+func reserveSpace(usr *user.User, size int64) error {
+	// Nothing to charge, a drive already over its size still takes what it reserved
+	if size == 0 {
+		return nil
+	}
+
+	ok, err := user.ReserveDrive(usr.Username, size)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errInsufficientSpace
+	}
+	usr.DriveUsed += size
+	return nil
+}
 
-	if len(fileList) == 0 {
-		return c.JSON(http.StatusOK, nil)
+// releaseSpace gives back size bytes reserved with reserveSpace
+func releaseSpace(usr *user.User, size int64) error {
+	if err := user.IncDriveUsed(usr.Username, -size); err != nil {
+		return err
 	}
+	usr.DriveUsed -= size
+	return nil
+}
 
-	return c.JSON(http.StatusOK, fileList)
+// createStaged creates a new empty file in the staging folder
+func createStaged() (*os.File, error) {
+	if err := os.MkdirAll(config.GetConfigDrive().StagingDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(config.GetConfigDrive().StagingDir, "upload-*")
+}
+
+// stageUpload writes r to a new file of the staging folder and returns its path
+func stageUpload(r io.Reader) (string, error) {
+	staged, err := createStaged()
+	if err != nil {
+		return "", err
+	}
+	defer staged.Close()
+
+	if _, err := io.Copy(staged, r); err != nil {
+		os.Remove(staged.Name())
+		return "", err
+	}
+	return staged.Name(), staged.Close()
+}
+
+// hashStaged returns the hex SHA-256 and the size of a staged
+// upload and rewinds it so it can be stored
+func hashStaged(src *os.File) (string, int64, error) {
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, src)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// sniffStaged returns the media type of a staged upload called name
+func sniffStaged(src *os.File, name string) string {
+	head := make([]byte, utils.MimeSniffLen)
+	n, _ := src.ReadAt(head, 0)
+	return utils.DetectMimeType(name, head[:n])
+}
+
+// commitUpload stores a completed upload staged at srcPath on local disk into
+// the folder dir of the user's drive, records it in the index and charges its
+// size to the user's drive. Bytes already reserved for the upload are not charged
+// again. The content is stored once per SHA-256: an upload identical to a file
+// already stored only adds a reference to it. The staged file is removed once stored.
+// Uploads the scanner finds malware in are quarantined instead, with errInfected.
+// It returns the name the file was stored under.
+func commitUpload(usr *user.User, dir, name, srcPath string, keepVersions bool, reserved int64) (string, error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	hash, size, err := hashStaged(src)
+	if err != nil {
+		return "", err
+	}
+
+	if err := scanUpload(usr, path.Join(utils.CleanDrivePath(dir), name), src, hash, size); err != nil {
+		return "", err
+	}
+	return storeStaged(usr, dir, name, src, hash, size, keepVersions, reserved)
+}
+
+// storeStaged is commitUpload once the staged upload src was hashed and scanned
+func storeStaged(usr *user.User, dir, name string, src *os.File, hash string, size int64, keepVersions bool, reserved int64) (string, error) {
+	done := user.BeginDriveChange(usr.Username)
+	defer done()
+
+	// The drive is charged the logical size even when the content is shared,
+	// the charge is given back if the file can't be stored
+	if err := reserveSpace(usr, size-reserved); err != nil {
+		return "", err
+	}
+
+	dir = utils.CleanDrivePath(dir)
+	dstName, prev, err := uploadDestination(usr, dir, name, keepVersions)
+	if err != nil {
+		releaseSpace(usr, size-reserved)
+		return "", err
+	}
+	dstPath := path.Join(dir, dstName)
+
+	mimeType := sniffStaged(src, dstName)
+	if _, err := blob.Store(context.Background(), hash, src, size); err != nil {
+		undoVersion(usr, dstPath, prev)
+		releaseSpace(usr, size-reserved)
+		return "", err
+	}
+	src.Close()
+	os.Remove(src.Name())
+
+	if err := indexFile(usr.Username, dir, dstName, size, hash, mimeType); err != nil {
+		blob.Release(hash)
+		undoVersion(usr, dstPath, prev)
+		releaseSpace(usr, size-reserved)
+		return "", err
+	}
+
+	// Drop the oldest versions over the role's limit
+	if prev != nil {
+		if err := pruneVersions(usr, path.Join(dir, dstName)); err != nil {
+			return "", err
+		}
+	}
+
+	return dstName, nil
+}
+
+// indexFile records a file stored in the user's drive in the files collection
+func indexFile(username, dir, name string, size int64, hash, mimeType string) error {
+	if err := file.EnsureDirs(username, dir); err != nil {
+		return err
+	}
+
+	f := file.NewFile(username, path.Join(dir, name), size, time.Now(), false)
+	f.Hash = hash
+	f.MimeType = mimeType
+	return f.AddFileToDB()
 }
 
 // Handler to download a file using streaming for a specific user
@@ -299,45 +551,127 @@ func DownloadFile(c echo.Context) error {
 		requestedFile = "." // Default to root if no path is provided
 	}
 
-	// Sanitize the filename
+	// Sanitize the filename, the clean path can't leave the user's drive
 	safeFilename, err := url.QueryUnescape(requestedFile)
 	if err != nil {
 		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid filename: %s", err))
 	}
+	safeFilename = utils.CleanDrivePath(safeFilename)
 
-	// Construct the full path to the file within the user's directory
-	userDir := filepath.Join(config.GetConfigDrive().UploadDir, usr.Username)
-	safePath := filepath.Join(userDir, safeFilename)
+	// Files shared by another user are downloaded with ?owner=
+	usr, status, err := driveOwner(c, usr, safeFilename, grant.RoleViewer)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
 
-	// Ensure that the requested file path is inside the user's directory
-	if !strings.HasPrefix(safePath, userDir) {
-		return c.String(http.StatusForbidden, "Invalid file path")
+	f, err := file.GetFile(usr.Username, safeFilename)
+	if err != nil {
+		return c.String(http.StatusNotFound, "File not found")
 	}
+	// Folders are sent as a ZIP archive
+	if f.IsDir {
+		return streamZip(c, usr.Username, []string{f.Path}, f.Filename+".zip")
+	}
+
+	return streamFile(c, f.ContentKey(), f.Filename, f.ContentType(), f.Hash)
+}
 
-	// Open the file for downloading
-	file, err := os.Open(safePath)
+// inlineCSP is the Content-Security-Policy of files shown in the browser,
+// nothing but the file itself may load and scripts never run
+const inlineCSP = "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'"
+
+// streamFile sends the object stored under key as an attachment called name.
+// With ?inline=1 images, PDFs, audio, video and plain text are shown in the
+// browser instead, any other type is still sent as an attachment.
+// Range, If-Range and the conditional GET headers are handled by http.ServeContent.
+// hash is the SHA-256 recorded when the file was uploaded, it is sent as the
+// digest and ETag of the file so clients can check what they received.
+// Files stored before deduplication have none.
+func streamFile(c echo.Context, key, name, mimeType, hash string) error {
+	ctx := c.Request().Context()
+	st := storage.GetStorage()
+
+	info, err := st.Stat(ctx, key)
+	if err == storage.ErrNotExist {
+		return c.String(http.StatusNotFound, "File not found")
+	}
 	if err != nil {
-		if os.IsNotExist(err) {
-			return c.String(http.StatusNotFound, "File not found")
-		}
 		return err
 	}
-	defer file.Close()
+
+	// Only the ranges the client asks for are read from the storage
+	content := storage.NewReadSeeker(ctx, st, key, info.Size)
+	defer content.Close()
 
 	// Set headers for downloading the file
-	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(safeFilename)))
-	c.Response().Header().Set(echo.HeaderContentType, "application/octet-stream")
+	disposition := "attachment"
+	if c.QueryParam("inline") == "1" && utils.IsInlineSafe(mimeType) {
+		disposition = "inline"
+		csp := inlineCSP
+		// Browsers refuse to run their PDF viewer in a sandbox
+		if utils.BaseMimeType(mimeType) != "application/pdf" {
+			csp += "; sandbox"
+		}
+		c.Response().Header().Set(echo.HeaderContentSecurityPolicy, csp)
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	c.Response().Header().Set(echo.HeaderContentType, mimeType)
 	c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+	if sum, err := hex.DecodeString(hash); err == nil && len(sum) == sha256.Size {
+		digest := base64.StdEncoding.EncodeToString(sum)
+		c.Response().Header().Set("Digest", "sha-256="+digest)
+		c.Response().Header().Set("Repr-Digest", "sha-256=:"+digest+":")
+		c.Response().Header().Set("ETag", hashETag(hash))
+	} else {
+		c.Response().Header().Set("ETag", fileETag(info.Size, info.ModTime))
+	}
+
+	// Stream the file, or the requested ranges of it, to the response
+	http.ServeContent(c.Response(), c.Request(), name, info.ModTime, content)
+	return nil
+}
 
-	// Stream the file to the response
-	if _, err = io.Copy(c.Response().Writer, file); err != nil {
+// fileETag builds a strong validator from the size and modification time of a file
+func fileETag(size int64, modTime time.Time) string {
+	return fmt.Sprintf("\"%x-%x\"", modTime.UnixNano(), size)
+}
+
+// hashETag builds a strong validator from the SHA-256 of a file's content
+func hashETag(hash string) string {
+	return fmt.Sprintf("\"sha256-%s\"", hash)
+}
+
+// jsonWithETag answers with the JSON of body, or with 304 Not Modified
+// when the client already holds the same content
+func jsonWithETag(c echo.Context, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	sum := sha256.Sum256(data)
+	etag := fmt.Sprintf("W/\"%s\"", hex.EncodeToString(sum[:16]))
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set(echo.HeaderCacheControl, "private, no-cache")
+
+	for _, match := range strings.Split(c.Request().Header.Get("If-None-Match"), ",") {
+		if strings.TrimPrefix(strings.TrimSpace(match), "W/") == strings.TrimPrefix(etag, "W/") {
+			return c.NoContent(http.StatusNotModified)
+		}
+	}
+
+	return c.JSONBlob(http.StatusOK, data)
 }
 
-// Handler to delete a file for a specific user
+// DeleteResult reports what happened to one item of a delete request
+type DeleteResult struct {
+	Path  string `json:"path"`
+	IsDir bool   `json:"is_dir"`
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+}
+
+// Handler to delete a file or a folder with everything inside it for a specific user
 func DeleteFile(c echo.Context) error {
 	// Get the authenticated user
 	usr := c.Get("user").(*user.User)
@@ -353,47 +687,147 @@ func DeleteFile(c echo.Context) error {
 	if err != nil {
 		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid filename: %s", err))
 	}
+	filename = utils.CleanDrivePath(filename)
 
-	// Construct the full path to the file within the user's directory
-	userDir := filepath.Join(config.GetConfigDrive().UploadDir, usr.Username)
-	safePath := filepath.Join(userDir, filename)
+	if filename == "/" {
+		return c.String(http.StatusForbidden, "The root folder can't be deleted")
+	}
 
-	// Ensure that the requested file path is inside the user's directory
-	if !strings.HasPrefix(safePath, userDir) {
-		return c.String(http.StatusForbidden, "Invalid file path")
+	// Editors delete from the owner's drive, the items go to the owner's trash
+	usr, status, err := driveOwner(c, usr, filename, grant.RoleEditor)
+	if err != nil {
+		return c.String(status, err.Error())
 	}
 
-	// Get the file info to determine its size
-	fileInfo, err := os.Stat(safePath)
-	if os.IsNotExist(err) {
-		return c.String(http.StatusNotFound, fmt.Sprintf("File %s not found.", filename))
-	} else if err != nil {
+	// Get the entry and everything below it, parents sort before their children
+	tree, err := file.GetTree(usr.Username, filename)
+	if err != nil {
 		return c.String(http.StatusInternalServerError, fmt.Sprintf("Error retrieving file info: %s", err))
 	}
+	if len(tree) == 0 {
+		return c.String(http.StatusNotFound, fmt.Sprintf("File %s not found.", filename))
+	}
 
-	// Update DriveUsed for the user
-	fileSize := fileInfo.Size() // Size of the deleted file
-	usr.DriveUsed -= fileSize   // Decrease the used space
-
-	collection := database.Collection(config.GetConfigDB().UserColl)
+	// Deleted items go to the trash unless the user asks to remove them for good.
+	// Files kept as blobs move with their entries, only older files have content to move.
+	if c.QueryParam("permanent") == "1" {
+		return deletePermanently(c, usr, filename, tree)
+	}
 
-	// Update user's DriveUsed in the database
-	_, err = collection.UpdateOne(
-		context.Background(),
-		bson.M{"username": usr.Username},
-		bson.M{"$set": bson.M{"drive_used": usr.DriveUsed}},
-	)
+	item, err := trashTree(c.Request().Context(), usr, filename, tree)
 	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":  fmt.Sprintf("File %s moved to trash.", filename),
+		"trash_id": item.TrashId,
+	})
+}
+
+// trashTree moves the entry filename and its tree to the user's trash
+func trashTree(ctx context.Context, usr *user.User, filename string, tree []file.File) (*trash.TrashItem, error) {
+	done := user.BeginDriveChange(usr.Username)
+	defer done()
+
+	// Empty folders only exist in the index, there is nothing to move for them
+	item := trash.NewTrashItem(usr.Username, usr.Role, tree)
+	err := storage.GetStorage().Move(ctx,
+		utils.DriveKey(usr.Username, filename), trash.ItemKey(usr.Username, item.TrashId))
+	if err != nil && err != storage.ErrNotExist {
+		return nil, fmt.Errorf("Failed to move file to trash: %s", err)
+	}
+
+	if err := item.AddTrashItemToDB(); err != nil {
+		return nil, fmt.Errorf("Failed to record trash item: %s", err)
+	}
+
+	// Trashed bytes still count toward DriveUsed until the item is purged
+	if err := file.DeleteFileFromDB(usr.Username, filename); err != nil {
+		return nil, fmt.Errorf("Failed to update index: %s", err)
+	}
+
+	// Versions go to the trash with the file, they come back on restore
+	if err := version.TrashVersions(usr.Username, filename, item.TrashId); err != nil {
+		return nil, fmt.Errorf("Failed to trash versions: %s", err)
+	}
+
+	// Access given to the tree doesn't carry over to what is stored there later
+	if err := grant.DeleteGrants(usr.Username, filename); err != nil {
+		return nil, fmt.Errorf("Failed to delete grants: %s", err)
+	}
+	if err := share.DeleteTreeShares(usr.Username, filename); err != nil {
+		return nil, fmt.Errorf("Failed to delete shares: %s", err)
+	}
+	return item, nil
+}
+
+// deletePermanently removes a tree from disk and the index and reports the result per item
+func deletePermanently(c echo.Context, usr *user.User, filename string, tree []file.File) error {
+	done := user.BeginDriveChange(usr.Username)
+	defer done()
+
+	// Remove children before their parents and count the bytes really freed
+	var freed int64
+	results := make([]DeleteResult, 0, len(tree))
+	failed := false
+	for i := len(tree) - 1; i >= 0; i-- {
+		f := tree[i]
+		result := DeleteResult{Path: f.Path, IsDir: f.IsDir, Size: f.Size}
+
+		err := storage.GetStorage().Delete(c.Request().Context(), utils.DriveKey(usr.Username, f.Path))
+		if err != nil {
+			result.Error = err.Error()
+			failed = true
+		} else if err = file.DeleteEntryFromDB(usr.Username, f.Path); err != nil {
+			result.Error = err.Error()
+			failed = true
+		} else if !f.IsDir {
+			freed += f.Size
+
+			// The entry is gone, a failed release only leaves an unused blob behind
+			if f.Hash != "" {
+				if err := blob.Release(f.Hash); err != nil {
+					result.Error = err.Error()
+					failed = true
+				}
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	// Update user's DriveUsed in the database with a single atomic update
+	if err := user.IncDriveUsed(usr.Username, -freed); err != nil {
 		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to update drive usage: %s", err))
 	}
+	usr.DriveUsed -= freed
 
-	// Remove the file
-	if err := os.Remove(safePath); err != nil {
-		if os.IsNotExist(err) {
-			return c.String(http.StatusNotFound, fmt.Sprintf("File %s not found.", filename))
+	if !failed {
+		if err := deleteVersions(usr, filename); err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to delete versions: %s", err))
 		}
-		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to delete file: %s", err))
+		if err := grant.DeleteGrants(usr.Username, filename); err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to delete grants: %s", err))
+		}
+	}
+
+	// Links to the tree are revoked even if some items are left, a link
+	// must not reach what is stored later at a deleted path
+	if err := share.DeleteTreeShares(usr.Username, filename); err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to delete shares: %s", err))
 	}
 
-	return c.String(http.StatusOK, fmt.Sprintf("File %s deleted successfully!", filename))
+	status := http.StatusOK
+	message := fmt.Sprintf("File %s deleted successfully!", filename)
+	if failed {
+		status = http.StatusMultiStatus
+		message = fmt.Sprintf("Some items in %s could not be deleted.", filename)
+	}
+
+	return c.JSON(status, map[string]interface{}{
+		"message": message,
+		"freed":   freed,
+		"items":   results,
+	})
 }
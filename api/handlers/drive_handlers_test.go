@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/blob"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/user"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/database"
+	"github.com/poriamsz55/distork/storage"
+)
+
+// connectTestDB connects to an empty distork_test database on the local
+// MongoDB, e.g. DISTORK_TEST_MONGO=1 go test ./api/handlers/
+func connectTestDB(t *testing.T) {
+	if os.Getenv("DISTORK_TEST_MONGO") == "" {
+		t.Skip("DISTORK_TEST_MONGO is not set")
+	}
+
+	config.GetConfigDB().DatabaseName = "distork_test"
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Drop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Drop(context.Background()) })
+}
+
+func Test_streamFile(t *testing.T) {
+	t.Setenv("DISTORK_STORAGE", "local")
+	t.Setenv("DISTORK_LOCAL_ROOT", t.TempDir())
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	key := "uploads/alice/a.txt"
+	_, err := storage.GetStorage().Put(context.Background(), key, strings.NewReader("0123456789"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("0123456789"))
+	hash := hex.EncodeToString(sum[:])
+
+	serve := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/drive/download?path=a.txt", nil)
+		req.Header = header
+		rec := httptest.NewRecorder()
+		if err := streamFile(echo.New().NewContext(req, rec), key, "a.txt", "text/plain; charset=utf-8", hash); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	full := serve(http.Header{})
+	etag := full.Header().Get("ETag")
+	if full.Code != http.StatusOK || full.Body.String() != "0123456789" || etag == "" {
+		t.Fatalf("full download: got %d %q etag %q", full.Code, full.Body.String(), etag)
+	}
+	if etag != hashETag(hash) {
+		t.Errorf("etag = %q, want one made from the hash", etag)
+	}
+	if digest := full.Header().Get("Digest"); digest != "sha-256="+base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Errorf("digest = %q", digest)
+	}
+
+	// Quotes and non-ASCII characters in the name are escaped
+	for _, name := range []string{`a "b".txt`, "résumé.txt", `a\";x=.txt`} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/drive/download?path=a.txt", nil)
+		if err := streamFile(echo.New().NewContext(req, rec), key, name, "text/plain; charset=utf-8", hash); err != nil {
+			t.Fatal(err)
+		}
+		disposition, params, err := mime.ParseMediaType(rec.Header().Get(echo.HeaderContentDisposition))
+		if err != nil || disposition != "attachment" || params["filename"] != name || len(params) != 1 {
+			t.Errorf("Content-Disposition for %q = %q", name, rec.Header().Get(echo.HeaderContentDisposition))
+		}
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		code   int
+		body   string
+	}{
+		{
+			name:   "range",
+			header: http.Header{"Range": {"bytes=2-4"}},
+			code:   http.StatusPartialContent,
+			body:   "234",
+		},
+		{
+			name:   "suffix range",
+			header: http.Header{"Range": {"bytes=-3"}},
+			code:   http.StatusPartialContent,
+			body:   "789",
+		},
+		{
+			name:   "stale if-range",
+			header: http.Header{"Range": {"bytes=2-4"}, "If-Range": {`"stale"`}},
+			code:   http.StatusOK,
+			body:   "0123456789",
+		},
+		{
+			name:   "if-none-match",
+			header: http.Header{"If-None-Match": {etag}},
+			code:   http.StatusNotModified,
+			body:   "",
+		},
+		{
+			name:   "multiple ranges",
+			header: http.Header{"Range": {"bytes=0-1,8-9"}},
+			code:   http.StatusPartialContent,
+		},
+		{
+			name:   "unsatisfiable",
+			header: http.Header{"Range": {"bytes=20-30"}},
+			code:   http.StatusRequestedRangeNotSatisfiable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(tt.header)
+			if rec.Code != tt.code {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.code)
+			}
+			if tt.body != "" && rec.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func Test_outermostPaths(t *testing.T) {
+	got := outermostPaths([]string{"/a/b", "/a", "/c", "/c", "/ab"})
+	want := []string{"/a", "/c", "/ab"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("outermostPaths = %v, want %v", got, want)
+	}
+
+	if got := outermostPaths([]string{"/", "/a", "/"}); len(got) != 1 || got[0] != "/" {
+		t.Errorf("outermostPaths with the root = %v, want [/]", got)
+	}
+}
+
+func TestUploadFileChunk_invalid(t *testing.T) {
+	for _, form := range []string{
+		"chunkNumber=0&totalChunks=2&fileName=a.txt&timestamp=../../x",
+		"chunkNumber=0&totalChunks=2&fileName=a.txt&timestamp=1%2F2",
+		"chunkNumber=../x&totalChunks=2&fileName=a.txt&timestamp=1700000000",
+		"chunkNumber=-1&totalChunks=2&fileName=a.txt&timestamp=1700000000",
+		"chunkNumber=2&totalChunks=2&fileName=a.txt&timestamp=1700000000",
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/drive/upload-chunk", strings.NewReader(form))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.Set("user", &user.User{Username: "alice"})
+
+		if err := UploadFileChunk(c); err != nil {
+			t.Errorf("UploadFileChunk(%q): %v", form, err)
+			continue
+		}
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("UploadFileChunk(%q) answered %d, want 400", form, rec.Code)
+		}
+	}
+}
+
+func Test_parseListing(t *testing.T) {
+	parse := func(query string) (*file.Listing, error) {
+		req := httptest.NewRequest(http.MethodGet, "/api/drive/files?"+query, nil)
+		return parseListing(echo.New().NewContext(req, httptest.NewRecorder()))
+	}
+
+	tests := []struct {
+		query        string
+		sort         string
+		desc         bool
+		foldersFirst bool
+	}{
+		{query: "", sort: "mtime", desc: true},
+		{query: "sort=name", sort: "name"},
+		{query: "sort=size", sort: "size", desc: true},
+		{query: "sort=type&order=desc&folders_first=1", sort: "type", desc: true, foldersFirst: true},
+		{query: "sort=mtime&order=asc", sort: "mtime"},
+	}
+	for _, tt := range tests {
+		l, err := parse(tt.query)
+		if err != nil {
+			t.Fatalf("parseListing(%q) error = %v", tt.query, err)
+		}
+		if l.Sort != tt.sort || l.Desc != tt.desc || l.FoldersFirst != tt.foldersFirst {
+			t.Errorf("parseListing(%q) = %+v", tt.query, l)
+		}
+	}
+
+	for _, query := range []string{"sort=owner", "order=up", "folders_first=maybe", "limit=0"} {
+		if _, err := parse(query); err == nil {
+			t.Errorf("parseListing(%q) succeeded", query)
+		}
+	}
+}
+
+// Test_commitUploadParallel lands more uploads at once than the drive holds,
+// some of them failing once their space is reserved
+func Test_commitUploadParallel(t *testing.T) {
+	connectTestDB(t)
+	t.Setenv("DISTORK_STORAGE", "local")
+	t.Setenv("DISTORK_LOCAL_ROOT", t.TempDir())
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	local, ok := storage.GetStorage().(*storage.Local)
+	if !ok {
+		t.Skip("the storage is not local")
+	}
+
+	const driveSize, uploadSize = 1000, 200
+	usr := &user.User{Username: "alice", Role: "user", DriveSize: driveSize}
+	if err := usr.AddUserToDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stage 10 uploads, every third one can't be stored: the folder of
+	// its blob is taken by a file
+	staging := t.TempDir()
+	staged := make([]string, 10)
+	failing := map[int]bool{}
+	for i := range staged {
+		content := []byte(strings.Repeat(fmt.Sprintf("%04d", i), uploadSize/4))
+		staged[i] = filepath.Join(staging, fmt.Sprintf("upload-%d", i))
+		if err := os.WriteFile(staged[i], content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if i%3 == 0 {
+			failing[i] = true
+			sum := sha256.Sum256(content)
+			blocked := filepath.Join(local.Root, filepath.FromSlash(blob.BlobKey(hex.EncodeToString(sum[:]))))
+			blocked = filepath.Dir(filepath.Dir(blocked))
+			if err := os.MkdirAll(filepath.Dir(blocked), os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(blocked, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Watch the recorded usage while the uploads land
+	stop := make(chan struct{})
+	var maxUsed int64
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if u, err := user.GetUserByUsername("alice"); err == nil && u.DriveUsed > maxUsed {
+				maxUsed = u.DriveUsed
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(staged))
+	for i := range staged {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Every request loads its own copy of the user
+			u, err := user.GetUserByUsername("alice")
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			_, errs[i] = commitUpload(&u, "/", fmt.Sprintf("file-%d.txt", i), staged[i], false, 0)
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	<-watched
+
+	stored := 0
+	for i, err := range errs {
+		switch {
+		case failing[i] && err == nil:
+			t.Errorf("upload %d was stored, its blob folder is a file", i)
+		case err == nil:
+			stored++
+		case !failing[i] && err != errInsufficientSpace:
+			t.Errorf("upload %d: %v", i, err)
+		}
+	}
+
+	if maxUsed > driveSize {
+		t.Errorf("DriveUsed reached %d, the drive holds %d", maxUsed, driveSize)
+	}
+	if stored == 0 || stored*uploadSize > driveSize {
+		t.Errorf("%d uploads stored", stored)
+	}
+
+	// Failed uploads gave their space back, only the stored files are charged
+	usage, err := file.DriveUsage("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := user.GetUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.DriveUsed != int64(stored*uploadSize) || usage["alice"] != u.DriveUsed {
+		t.Errorf("DriveUsed = %d, %d bytes indexed, want %d", u.DriveUsed, usage["alice"], stored*uploadSize)
+	}
+}
@@ -0,0 +1,406 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/blob"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/user"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// errUnsafeArchive is returned for archives that break the extraction limits
+// or hold entries that would land outside the target folder
+var errUnsafeArchive = errors.New("unsafe archive")
+
+// archiveEntry is a file or folder of an uploaded archive
+type archiveEntry struct {
+	Path    string // clean path relative to the extraction folder, e.g. /src/main.go
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// archiveFormat returns "zip" or "tar.gz" from the name of an archive, "" for anything else
+func archiveFormat(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	}
+	return ""
+}
+
+// extractUpload extracts the archive staged at archivePath into the folder dir
+// of the user's drive and answers the request. Every entry is checked and the
+// extracted size is charged to the drive before anything is written. An
+// extraction that fails partway is undone.
+func extractUpload(c echo.Context, usr *user.User, dir, archivePath, archiveName string) error {
+	format := archiveFormat(archiveName)
+	if format == "" {
+		return c.String(http.StatusBadRequest, "Only .zip, .tar.gz and .tgz archives can be extracted")
+	}
+
+	// Scanners look inside archives, an infected one is quarantined whole
+	if err := scanStagedFile(usr, path.Join(utils.CleanDrivePath(dir), archiveName), archivePath); err != nil {
+		return uploadError(c, err)
+	}
+
+	total, err := scanArchive(format, archivePath)
+	if errors.Is(err, errUnsafeArchive) {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid archive: %s", err))
+	}
+
+	done := user.BeginDriveChange(usr.Username)
+	defer done()
+
+	err = reserveSpace(usr, total)
+	if err == errInsufficientSpace {
+		return c.String(http.StatusForbidden, err.Error())
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to update drive usage: %s", err))
+	}
+
+	dir = utils.CleanDrivePath(dir)
+	x := &extraction{usr: usr, known: map[string]bool{}}
+	err = walkArchive(format, archivePath, func(e archiveEntry, open func() (io.ReadCloser, error)) error {
+		target := path.Join(dir, e.Path)
+		if e.IsDir {
+			return x.ensureDir(target)
+		}
+		if err := x.ensureDir(path.Dir(target)); err != nil {
+			return err
+		}
+		return x.extractEntry(path.Dir(target), path.Base(target), e, open)
+	})
+
+	// Nothing of an extraction that failed partway stays in the drive or charged
+	if err != nil {
+		x.undo()
+		releaseSpace(usr, total)
+		switch {
+		case errors.Is(err, errExtractConflict):
+			return c.String(http.StatusConflict, fmt.Sprintf("Nothing was extracted: %s", err))
+		case errors.Is(err, errUnsafeArchive):
+			return c.String(http.StatusUnprocessableEntity, fmt.Sprintf("Nothing was extracted: %s", err))
+		}
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Nothing was extracted: %s", err))
+	}
+
+	written, count := x.size(), len(x.files)
+	if written != total {
+		releaseSpace(usr, total-written)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("%s extracted successfully.", archiveName),
+		"path":    dir,
+		"files":   count,
+		"size":    written,
+	})
+}
+
+// errExtractConflict is returned when an entry of an archive would replace
+// a file of the drive by a folder
+var errExtractConflict = errors.New("conflicts with the drive")
+
+// extractedFile is a file an extraction stored
+type extractedFile struct {
+	Path string
+	Hash string
+	Size int64
+}
+
+// extraction keeps what the extraction of an archive wrote to the drive of
+// usr, so that it can be undone when it fails partway
+type extraction struct {
+	usr   *user.User
+	known map[string]bool // folders known to exist
+	dirs  []string        // folders created, parents first
+	files []extractedFile
+}
+
+// size returns the bytes of the files extracted
+func (x *extraction) size() int64 {
+	var size int64
+	for _, f := range x.files {
+		size += f.Size
+	}
+	return size
+}
+
+// ensureDir adds the folder dir and its parents and records those it created
+func (x *extraction) ensureDir(dir string) error {
+	var missing []string
+	for p := dir; p != "/" && !x.known[p]; p = path.Dir(p) {
+		f, err := file.GetFile(x.usr.Username, p)
+		if err == mongo.ErrNoDocuments {
+			missing = append(missing, p)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !f.IsDir {
+			return fmt.Errorf("%w: %s is a file", errExtractConflict, p)
+		}
+		x.known[p] = true
+		break
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if err := file.EnsureDirs(x.usr.Username, dir); err != nil {
+		return err
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		x.known[missing[i]] = true
+		x.dirs = append(x.dirs, missing[i])
+	}
+	return nil
+}
+
+// extractEntry stores one file of an archive in the folder dir, a file with the
+// same name gets a "name (1)" copy
+func (x *extraction) extractEntry(dir, name string, e archiveEntry, open func() (io.ReadCloser, error)) error {
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Never trust the size an entry claims, read at most one byte more to notice a lie
+	staged, err := stageUpload(io.LimitReader(r, e.Size+1))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged)
+
+	src, err := os.Open(staged)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	hash, size, err := hashStaged(src)
+	if err != nil {
+		return err
+	}
+	if size != e.Size {
+		return fmt.Errorf("%w: %s is not the size it claims", errUnsafeArchive, e.Path)
+	}
+
+	dstName, _, err := uploadDestination(x.usr, dir, name, false)
+	if err != nil {
+		return err
+	}
+
+	mimeType := sniffStaged(src, dstName)
+	if _, err := blob.Store(context.Background(), hash, src, size); err != nil {
+		return err
+	}
+	if err := indexFile(x.usr.Username, dir, dstName, size, hash, mimeType); err != nil {
+		blob.Release(hash)
+		return err
+	}
+	x.files = append(x.files, extractedFile{Path: path.Join(dir, dstName), Hash: hash, Size: size})
+	return nil
+}
+
+// undo removes the files and folders the extraction wrote. A file replaced
+// meanwhile, or a folder something else was put in, stays.
+func (x *extraction) undo() {
+	for _, extracted := range x.files {
+		f, err := file.GetFile(x.usr.Username, extracted.Path)
+		if err != nil || f.Hash != extracted.Hash {
+			continue
+		}
+		if err := file.DeleteEntryFromDB(x.usr.Username, extracted.Path); err != nil {
+			log.Printf("Undoing the extraction of %s for %s failed: %s", extracted.Path, x.usr.Username, err)
+			continue
+		}
+		blob.Release(extracted.Hash)
+	}
+
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		children, err := file.GetFilesByDir(x.usr.Username, x.dirs[i])
+		if err != nil || len(children) > 0 {
+			continue
+		}
+		file.DeleteEntryFromDB(x.usr.Username, x.dirs[i])
+	}
+}
+
+// scanArchive reads the entries of an archive without extracting anything and
+// checks them against the limits. It returns the bytes the files extract to.
+func scanArchive(format, archivePath string) (int64, error) {
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return 0, err
+	}
+
+	drive := config.GetConfigDrive()
+	count := 0
+	var total int64
+	files, dirs := map[string]bool{}, map[string]bool{}
+	err = walkArchive(format, archivePath, func(e archiveEntry, _ func() (io.ReadCloser, error)) error {
+		count++
+		if count > drive.ExtractMaxEntries {
+			return fmt.Errorf("%w: more than %d entries", errUnsafeArchive, drive.ExtractMaxEntries)
+		}
+
+		// A name is either a file or a folder, e.g. never a file a and a file a/b
+		for p := path.Dir(e.Path); p != "/"; p = path.Dir(p) {
+			if files[p] {
+				return fmt.Errorf("%w: %s is both a file and a folder", errUnsafeArchive, p)
+			}
+			dirs[p] = true
+		}
+		if e.IsDir {
+			if files[e.Path] {
+				return fmt.Errorf("%w: %s is both a file and a folder", errUnsafeArchive, e.Path)
+			}
+			dirs[e.Path] = true
+		} else {
+			if dirs[e.Path] {
+				return fmt.Errorf("%w: %s is both a file and a folder", errUnsafeArchive, e.Path)
+			}
+			files[e.Path] = true
+		}
+
+		total += e.Size
+		if total > drive.ExtractMaxSize {
+			return fmt.Errorf("%w: extracts to more than %d bytes", errUnsafeArchive, drive.ExtractMaxSize)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// A small archive that expands enormously is a zip bomb
+	if total/max(info.Size(), 1) > drive.ExtractMaxRatio {
+		return 0, fmt.Errorf("%w: compression ratio over %d", errUnsafeArchive, drive.ExtractMaxRatio)
+	}
+	return total, nil
+}
+
+// walkArchive calls fn for every file and folder of an archive in order. open
+// returns the content of a file, it is only valid until fn returns.
+// Links and special files are skipped.
+func walkArchive(format, archivePath string, fn func(e archiveEntry, open func() (io.ReadCloser, error)) error) error {
+	if format == "zip" {
+		zr, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+
+		for _, zf := range zr.File {
+			mode := zf.Mode()
+			if !mode.IsRegular() && !mode.IsDir() {
+				continue
+			}
+
+			p, err := archiveEntryPath(zf.Name)
+			if err != nil {
+				return err
+			}
+			if p == "/" {
+				continue
+			}
+
+			// The sizes of the central directory are checked by the zip reader when reading
+			if zf.CompressedSize64 > 0 && int64(zf.UncompressedSize64/zf.CompressedSize64) > config.GetConfigDrive().ExtractMaxRatio {
+				return fmt.Errorf("%w: %s has a compression ratio over %d", errUnsafeArchive, p, config.GetConfigDrive().ExtractMaxRatio)
+			}
+
+			e := archiveEntry{Path: p, Size: int64(zf.UncompressedSize64), ModTime: zf.Modified, IsDir: mode.IsDir()}
+			if err := fn(e, zf.Open); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+			continue
+		}
+
+		p, err := archiveEntryPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if p == "/" {
+			continue
+		}
+
+		e := archiveEntry{Path: p, Size: hdr.Size, ModTime: hdr.ModTime, IsDir: hdr.Typeflag == tar.TypeDir}
+		open := func() (io.ReadCloser, error) {
+			return io.NopCloser(tr), nil
+		}
+		if err := fn(e, open); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveEntryPath turns the name of an archive entry into a path below the
+// extraction folder. Absolute names and ".." elements are refused outright
+// instead of being cleaned, they only appear in archives built to escape (zip-slip).
+func archiveEntryPath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", fmt.Errorf("%w: absolute path %s", errUnsafeArchive, name)
+	}
+
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("%w: %s leaves the target folder", errUnsafeArchive, name)
+		}
+	}
+	return utils.CleanDrivePath(name), nil
+}
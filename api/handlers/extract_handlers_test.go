@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/blob"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/user"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/storage"
+)
+
+func Test_archiveEntryPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  bool
+	}{
+		{name: "src/main.go", want: "/src/main.go"},
+		{name: "./docs/", want: "/docs"},
+		{name: "../evil.sh", err: true},
+		{name: "a/../../evil.sh", err: true},
+		{name: "..\\evil.sh", err: true},
+		{name: "/etc/passwd", err: true},
+		{name: "C:\\evil.sh", err: true},
+	}
+	for _, tt := range tests {
+		got, err := archiveEntryPath(tt.name)
+		if tt.err {
+			if !errors.Is(err, errUnsafeArchive) {
+				t.Errorf("archiveEntryPath(%q) error = %v, want errUnsafeArchive", tt.name, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("archiveEntryPath(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func Test_scanArchive(t *testing.T) {
+	writeZip := func(files map[string][]byte) string {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for name, content := range files {
+			w, err := zw.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(content)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		p := filepath.Join(t.TempDir(), "a.zip")
+		if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	total, err := scanArchive("zip", writeZip(map[string][]byte{"a.txt": []byte("hello"), "dir/b.txt": []byte("world")}))
+	if err != nil || total != 10 {
+		t.Errorf("scanArchive = %d, %v, want 10 bytes", total, err)
+	}
+
+	if _, err := scanArchive("zip", writeZip(map[string][]byte{"../a.txt": []byte("hello")})); !errors.Is(err, errUnsafeArchive) {
+		t.Errorf("zip-slip: error = %v, want errUnsafeArchive", err)
+	}
+
+	for _, files := range []map[string][]byte{
+		{"a": []byte("file"), "a/b": []byte("file below it")},
+		{"a/": nil, "a": []byte("file")},
+		{"a/b/c.txt": []byte("deep"), "a/b": []byte("file")},
+	} {
+		if _, err := scanArchive("zip", writeZip(files)); !errors.Is(err, errUnsafeArchive) {
+			t.Errorf("file and folder of the same name: error = %v, want errUnsafeArchive", err)
+		}
+	}
+
+	bomb := make([]byte, 10*1024*1024)
+	if _, err := scanArchive("zip", writeZip(map[string][]byte{"zeros": bomb})); !errors.Is(err, errUnsafeArchive) {
+		t.Errorf("zip bomb: error = %v, want errUnsafeArchive", err)
+	}
+}
+
+// Test_extractUploadUndone extracts an archive whose last entry conflicts
+// with a file of the drive, the files extracted before it are removed
+func Test_extractUploadUndone(t *testing.T) {
+	connectTestDB(t)
+	t.Setenv("DISTORK_STORAGE", "local")
+	t.Setenv("DISTORK_LOCAL_ROOT", t.TempDir())
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	drive := config.GetConfigDrive()
+	stagingDir := drive.StagingDir
+	drive.StagingDir = t.TempDir()
+	t.Cleanup(func() { drive.StagingDir = stagingDir })
+
+	usr := &user.User{Username: "alice", Role: "user", DriveSize: 1000, DriveUsed: 5}
+	if err := usr.AddUserToDB(); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("taken"))
+	if _, err := blob.Store(context.Background(), hex.EncodeToString(sum[:]), strings.NewReader("taken"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexFile("alice", "/docs", "b", 5, hex.EncodeToString(sum[:]), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entries are written in order, new/a.txt is extracted before b/c.txt conflicts
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"new/a.txt", "b/c.txt"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(name))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "a.zip")
+	if err := os.WriteFile(archive, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/api/drive/upload", nil), rec)
+	if err := extractUpload(c, usr, "/docs", archive, "a.zip"); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("extraction answered %d %s, want 409", rec.Code, rec.Body)
+	}
+
+	for _, p := range []string{"/docs/new/a.txt", "/docs/new"} {
+		if _, err := file.GetFile("alice", p); err == nil {
+			t.Errorf("%s was left in the drive", p)
+		}
+	}
+	if _, err := file.GetFile("alice", "/docs/b"); err != nil {
+		t.Errorf("the conflicting file is gone: %v", err)
+	}
+	sum = sha256.Sum256([]byte("new/a.txt"))
+	if refs := blobRefs(t, hex.EncodeToString(sum[:])); refs != 0 {
+		t.Errorf("references of the extracted content = %d, want 0", refs)
+	}
+	if u, _ := user.GetUserByUsername("alice"); u.DriveUsed != 5 {
+		t.Errorf("DriveUsed = %d, want 5", u.DriveUsed)
+	}
+}
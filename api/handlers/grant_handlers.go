@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/grant"
+	"github.com/poriamsz55/distork/api/models/user"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SharedItem is a file or folder another user gave the caller access to
+type SharedItem struct {
+	file.File
+	GrantId string `json:"grant_id"`
+	Role    string `json:"role"`
+}
+
+// Handler to give another user access to a file or folder of the user's drive.
+// Granting again changes the role.
+func CreateGrant(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	p := utils.CleanDrivePath(c.QueryParam("path"))
+	if p == "/" {
+		return c.String(http.StatusBadRequest, "The root folder can't be shared")
+	}
+
+	role := c.FormValue("role")
+	if !grant.ValidRole(role) {
+		return c.String(http.StatusBadRequest, "Role must be viewer or editor")
+	}
+
+	grantee := c.FormValue("username")
+	if grantee == usr.Username {
+		return c.String(http.StatusBadRequest, "You already own this drive")
+	}
+	if _, err := user.GetUserByUsername(grantee); err != nil {
+		return c.String(http.StatusNotFound, fmt.Sprintf("User %s not found.", grantee))
+	}
+
+	f, err := file.GetFile(usr.Username, p)
+	if err != nil {
+		return c.String(http.StatusNotFound, fmt.Sprintf("File %s not found.", p))
+	}
+
+	g := grant.NewGrant(usr.Username, p, f.IsDir, grantee, role)
+	if err := g.AddGrantToDB(); err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to share: %s", err))
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("%s shared with %s as %s.", f.Filename, grantee, role),
+		"grant":   g,
+	})
+}
+
+// Handler to list the grants the user gave on a path and below it, the whole drive by default
+func ListGrants(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	grants, err := grant.GetGrants(usr.Username, c.QueryParam("path"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, grants)
+}
+
+// Handler to revoke a grant the user gave
+func RevokeGrant(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	err := grant.DeleteGrant(usr.Username, c.QueryParam("id"))
+	if err == mongo.ErrNoDocuments {
+		return c.String(http.StatusNotFound, "Grant not found")
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to revoke grant: %s", err))
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Access revoked.",
+	})
+}
+
+// Handler to list what other users shared with the user. The items are
+// browsed with the drive routes by adding ?owner= with the owner's username.
+func ListSharedWithMe(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	grants, err := grant.GetGrantsTo(usr.Username)
+	if err != nil {
+		return err
+	}
+
+	items := []SharedItem{}
+	for _, g := range grants {
+		// Grants on deleted files stay until they are revoked
+		f, err := file.GetFile(g.UUsername, g.Path)
+		if err != nil {
+			continue
+		}
+		shared := []file.File{*f}
+		addThumbnailURLs(shared, g.UUsername)
+		items = append(items, SharedItem{File: shared[0], GrantId: g.GrantId, Role: g.Role})
+	}
+
+	return c.JSON(http.StatusOK, items)
+}
+
+// driveOwner returns the user whose drive a request on p works on. Without
+// ?owner= it is the caller, otherwise the caller needs a grant of at least
+// role on p from that owner. The status is the HTTP code to answer with on error.
+func driveOwner(c echo.Context, usr *user.User, p, role string) (*user.User, int, error) {
+	return grantedOwner(usr, c.QueryParam("owner"), p, role)
+}
+
+// grantedOwner is driveOwner for a request whose owner was picked earlier,
+// like the later requests of an upload started with ?owner=
+func grantedOwner(usr *user.User, ownerName, p, role string) (*user.User, int, error) {
+	if ownerName == "" || ownerName == usr.Username {
+		return usr, http.StatusOK, nil
+	}
+
+	g, err := grant.FindGrant(ownerName, usr.Username, p)
+	if err == mongo.ErrNoDocuments {
+		return nil, http.StatusForbidden, fmt.Errorf("You don't have access to %s", utils.CleanDrivePath(p))
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if !g.Allows(role) {
+		return nil, http.StatusForbidden, fmt.Errorf("You can only view %s", utils.CleanDrivePath(p))
+	}
+
+	owner, err := user.GetUserByUsername(ownerName)
+	if err != nil {
+		return nil, http.StatusNotFound, fmt.Errorf("User %s not found", ownerName)
+	}
+	return &owner, http.StatusOK, nil
+}
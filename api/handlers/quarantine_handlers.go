@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/quarantine"
+	"github.com/poriamsz55/distork/api/models/user"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/scanner"
+	"github.com/poriamsz55/distork/storage"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// errInfected is returned when an upload was quarantined instead of stored
+var errInfected = errors.New("Malware was found in the file, it was quarantined for review.")
+
+// errScanFailed is returned when an upload could not be scanned, it is refused
+var errScanFailed = errors.New("The file could not be checked for malware, try again later.")
+
+// errScanTooLarge is returned when an upload is larger than the scanner takes
+// and such uploads are refused
+var errScanTooLarge = errors.New("The file is too large to be checked for malware.")
+
+// uploadStatus returns the status answering an upload that failed with err
+func uploadStatus(err error) int {
+	switch {
+	case err == errInsufficientSpace:
+		return http.StatusForbidden
+	case errors.Is(err, errInfected):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errScanFailed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errScanTooLarge):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// uploadError answers an upload that failed with err
+func uploadError(c echo.Context, err error) error {
+	status := uploadStatus(err)
+	if status == http.StatusInternalServerError {
+		return c.String(status, fmt.Sprintf("Failed to store file: %s", err))
+	}
+	return c.String(status, err.Error())
+}
+
+// scanUpload checks the staged upload src, going to p in the user's drive,
+// for malware. An infected upload is moved to the quarantine, out of the
+// user's drive, and errInfected is returned. Without a scanner every upload passes.
+func scanUpload(usr *user.User, p string, src *os.File, hash string, size int64) error {
+	sc := scanner.GetScanner()
+	if sc == nil {
+		return nil
+	}
+
+	// Larger uploads would be refused by the scanner, the policy says what to do with them
+	cfg := config.GetConfigScanner()
+	if cfg.MaxSize > 0 && size > cfg.MaxSize {
+		if cfg.Oversize == config.OversizeStore {
+			log.Printf("Upload %s of %s stored without being scanned: %d bytes is over the scan limit", p, usr.Username, size)
+			return nil
+		}
+		return errScanTooLarge
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	// Read with ReadAt, the position in src is kept for storing it
+	res, err := sc.Scan(ctx, io.NewSectionReader(src, 0, size))
+	if err != nil {
+		if cfg.FailOpen {
+			log.Printf("Upload %s of %s stored without being scanned: %s", p, usr.Username, err)
+			return nil
+		}
+		log.Printf("Upload %s of %s refused, it could not be scanned: %s", p, usr.Username, err)
+		return errScanFailed
+	}
+	if !res.Infected {
+		return nil
+	}
+
+	q := quarantine.NewItem(usr.Username, p, size, hash, res.Signature)
+	if _, err := storage.GetStorage().Put(ctx, q.ContentKey(), io.NewSectionReader(src, 0, size), size); err != nil {
+		return err
+	}
+	if err := q.AddItemToDB(); err != nil {
+		storage.GetStorage().Delete(context.Background(), q.ContentKey())
+		return err
+	}
+
+	log.Printf("Upload %s of %s quarantined as %s: %s", p, usr.Username, q.QuarantineId, res.Signature)
+	return fmt.Errorf("%w (%s, %s)", errInfected, path.Base(p), res.Signature)
+}
+
+// scanStagedFile is scanUpload for an upload staged at srcPath that is not
+// stored as it is, like an archive being extracted
+func scanStagedFile(usr *user.User, p, srcPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	hash, size, err := hashStaged(src)
+	if err != nil {
+		return err
+	}
+	return scanUpload(usr, p, src, hash, size)
+}
+
+// Handler to list the uploads of the user that were quarantined, with the
+// malware found in them. They wait there until an admin reviews them.
+func ListQuarantine(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	items, err := quarantine.GetItems(usr.Username)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, items)
+}
+
+// Handler to list the quarantined uploads of every user, or of ?username=
+func ListQuarantinedUploads(c echo.Context) error {
+	items, err := quarantine.GetItems(c.QueryParam("username"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, items)
+}
+
+// Handler to deliver a quarantined upload to the drive it was sent to, when
+// the admin finds it was wrongly flagged. It is charged to the owner's drive
+// and renamed if its path was taken meanwhile. The item is taken out of the
+// quarantine first, so two releases can't both store it, and put back when
+// it can't be released.
+func ReleaseQuarantined(c echo.Context) error {
+	q, err := quarantine.TakeItem(c.FormValue("quarantine_id"))
+	if err == mongo.ErrNoDocuments {
+		return c.String(http.StatusNotFound, "Quarantined upload not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	released := false
+	defer func() {
+		if !released {
+			q.AddItemToDB()
+		}
+	}()
+
+	owner, err := user.GetUserByUsername(q.UUsername)
+	if err == mongo.ErrNoDocuments {
+		return c.String(http.StatusNotFound, fmt.Sprintf("User %s not found.", q.UUsername))
+	}
+	if err != nil {
+		return err
+	}
+
+	// Stage the content again, it is stored like an upload
+	r, err := storage.GetStorage().Get(c.Request().Context(), q.ContentKey(), 0, -1)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to read quarantined upload: %s", err))
+	}
+	staged, err := stageUpload(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged)
+
+	src, err := os.Open(staged)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	hash, size, err := hashStaged(src)
+	if err != nil {
+		return err
+	}
+	if hash != q.Hash {
+		return c.String(http.StatusConflict, "The quarantined upload changed since it was flagged.")
+	}
+
+	name, err := storeStaged(&owner, path.Dir(q.Path), path.Base(q.Path), src, hash, size, false, 0)
+	if err != nil {
+		return c.String(uploadStatus(err), fmt.Sprintf("Failed to release upload: %s", err))
+	}
+	released = true
+
+	if err := q.DeleteContent(); err != nil {
+		log.Printf("Quarantined upload %s was released but its content was kept: %s", q.QuarantineId, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message":  fmt.Sprintf("Upload released to %s.", q.UUsername),
+		"path":     path.Join(path.Dir(q.Path), name),
+		"username": q.UUsername,
+	})
+}
+
+// Handler to delete a quarantined upload for good
+func DeleteQuarantined(c echo.Context) error {
+	q, err := quarantine.TakeItem(c.FormValue("quarantine_id"))
+	if err == mongo.ErrNoDocuments {
+		return c.String(http.StatusNotFound, "Quarantined upload not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := q.DeleteContent(); err != nil {
+		q.AddItemToDB()
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to delete quarantined upload: %s", err))
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Quarantined upload deleted.",
+	})
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/user"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/utils"
+)
+
+// Handler to search the whole drive of the user. Every parameter is optional:
+//
+//	name=report or name=*.jpg     substring or glob on the file name
+//	ext=jpg,png                   extensions, also as repeated parameters
+//	mime=image/png or mime=image/ media type or prefix of one
+//	min_size, max_size            bytes
+//	after, before                 modification time, RFC 3339 or 2006-01-02
+//	sort=name|size|mtime, order=asc|desc, offset, limit
+func SearchFiles(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	s, err := parseSearch(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	files, total, err := file.SearchFiles(usr.Username, s)
+	if err != nil {
+		return err
+	}
+	addThumbnailURLs(files, "")
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items":  files,
+		"total":  total,
+		"offset": s.Offset,
+		"limit":  s.Limit,
+	})
+}
+
+// parseSearch reads the filters, order and page of a search from the query
+func parseSearch(c echo.Context) (*file.Search, error) {
+	drive := config.GetConfigDrive()
+	s := &file.Search{
+		Name:     strings.TrimSpace(c.QueryParam("name")),
+		MimeType: strings.TrimSpace(c.QueryParam("mime")),
+		Sort:     c.QueryParam("sort"),
+		Limit:    drive.SearchPageSize,
+	}
+
+	if s.Name != "" {
+		if _, err := utils.NamePattern(s.Name); err != nil {
+			return nil, fmt.Errorf("Invalid name %q, a [...] class is not valid", s.Name)
+		}
+	}
+
+	for _, value := range c.QueryParams()["ext"] {
+		for _, ext := range strings.Split(value, ",") {
+			if ext = strings.TrimSpace(ext); ext != "" {
+				s.Exts = append(s.Exts, ext)
+			}
+		}
+	}
+
+	if s.Sort == "" {
+		s.Sort = "name"
+	}
+	if _, ok := file.SearchSorts[s.Sort]; !ok {
+		return nil, fmt.Errorf("Invalid sort %q, use name, size or mtime", s.Sort)
+	}
+	switch c.QueryParam("order") {
+	case "", "asc":
+	case "desc":
+		s.Desc = true
+	default:
+		return nil, fmt.Errorf("Invalid order %q, use asc or desc", c.QueryParam("order"))
+	}
+
+	for param, dst := range map[string]**int64{"min_size": &s.MinSize, "max_size": &s.MaxSize} {
+		if value := c.QueryParam(param); value != "" {
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("Invalid %s %q", param, value)
+			}
+			*dst = &size
+		}
+	}
+
+	for param, dst := range map[string]*time.Time{"after": &s.After, "before": &s.Before} {
+		if value := c.QueryParam(param); value != "" {
+			t, err := parseSearchTime(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s %q, use RFC 3339 or YYYY-MM-DD", param, value)
+			}
+			*dst = t
+		}
+	}
+
+	if value := c.QueryParam("offset"); value != "" {
+		offset, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("Invalid offset %q", value)
+		}
+		s.Offset = offset
+	}
+	if value := c.QueryParam("limit"); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("Invalid limit %q", value)
+		}
+		s.Limit = min(limit, drive.SearchMaxPageSize)
+	}
+
+	return s, nil
+}
+
+func parseSearchTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
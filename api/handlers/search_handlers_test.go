@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func Test_parseSearch(t *testing.T) {
+	parse := func(query string) error {
+		req := httptest.NewRequest(http.MethodGet, "/api/drive/search?"+query, nil)
+		_, err := parseSearch(echo.New().NewContext(req, httptest.NewRecorder()))
+		return err
+	}
+
+	req := httptest.NewRequest(http.MethodGet,
+		"/api/drive/search?name=*.jpg&ext=jpg,png&ext=gif&min_size=10&after=2024-05-01&sort=size&order=desc&limit=100000", nil)
+	s, err := parseSearch(echo.New().NewContext(req, httptest.NewRecorder()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Exts) != 3 || s.MinSize == nil || *s.MinSize != 10 || s.MaxSize != nil {
+		t.Errorf("filters = %+v", s)
+	}
+	if s.After.IsZero() || !s.Before.IsZero() || s.Sort != "size" || !s.Desc || s.Limit != 500 {
+		t.Errorf("search = %+v", s)
+	}
+
+	for _, query := range []string{"sort=owner", "order=up", "min_size=-1", "max_size=big", "after=yesterday", "limit=0", "offset=-5", "name=[z-a]"} {
+		if err := parse(query); err == nil {
+			t.Errorf("parseSearch(%q) succeeded", query)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/grant"
+	"github.com/poriamsz55/distork/api/models/upload"
+	"github.com/poriamsz55/distork/api/models/user"
+	config "github.com/poriamsz55/distork/configs"
+)
+
+// Handler to start an upload session. The whole size of the file is
+// reserved in the user's drive before any chunk is accepted.
+func CreateUploadSession(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	fileName := filepath.Base(c.FormValue("fileName"))
+	if !validName(fileName) {
+		return c.String(http.StatusBadRequest, "Invalid fileName")
+	}
+
+	size, err := strconv.ParseInt(c.FormValue("size"), 10, 64)
+	if err != nil || size <= 0 {
+		return c.String(http.StatusBadRequest, "Invalid size")
+	}
+
+	chunkSize, err := strconv.ParseInt(c.FormValue("chunkSize"), 10, 64)
+	if err != nil || chunkSize <= 0 || chunkSize > config.GetConfigDrive().MaxChunkSize {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("chunkSize must be between 1 and %d", config.GetConfigDrive().MaxChunkSize))
+	}
+
+	// Every chunk costs a file and an entry in the session, their number is bounded
+	maxChunks := int64(config.GetConfigDrive().MaxSessionChunks)
+	if (size+chunkSize-1)/chunkSize > maxChunks {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("chunkSize must be at least %d for this size, a session has at most %d chunks",
+			(size+maxChunks-1)/maxChunks, maxChunks))
+	}
+
+	fileHash := strings.ToLower(c.FormValue("sha256"))
+	if !validSHA256(fileHash) {
+		return c.String(http.StatusBadRequest, "Invalid sha256")
+	}
+
+	// Uploads into a folder shared by another user go to the
+	// owner's drive and count against the owner's quota
+	owner, status, err := driveOwner(c, usr, c.QueryParam("path"), grant.RoleEditor)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	// Reserve the space for the whole file, the session counts it once recorded
+	done := user.BeginDriveChange(owner.Username)
+	defer done()
+
+	err = reserveSpace(owner, size)
+	if err == errInsufficientSpace {
+		return c.String(http.StatusForbidden, err.Error())
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to update drive usage: %s", err))
+	}
+
+	s := upload.NewUploadSession(owner.Username, c.QueryParam("path"), fileName, size, chunkSize, fileHash)
+	s.Mode = c.QueryParam("mode")
+	s.Reserved = size
+	if owner != usr {
+		s.Uploader = usr.Username
+	}
+	if err := os.MkdirAll(s.Dir(), os.ModePerm); err != nil {
+		releaseSpace(owner, size)
+		return err
+	}
+
+	if err := s.AddUploadSessionToDB(); err != nil {
+		releaseSpace(owner, size)
+		os.RemoveAll(s.Dir())
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to create upload session: %s", err))
+	}
+
+	return c.JSON(http.StatusCreated, s)
+}
+
+// Handler to show which chunks of a session the server already has
+func GetUploadSession(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	s, err := upload.GetUploadSession(usr.Username, c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusNotFound, "Upload session not found")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"session": s,
+		"missing": s.Missing(),
+	})
+}
+
+// Handler to receive one chunk of a session, in any order. The request body is
+// the raw chunk and the X-Chunk-Sha256 header its hex SHA-256 digest.
+// The file is assembled and verified as soon as the last missing chunk arrives.
+func UploadSessionChunk(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	s, err := upload.GetUploadSession(usr.Username, c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusNotFound, "Upload session not found")
+	}
+	if s.State != upload.SessionReceiving {
+		return c.String(http.StatusConflict, "Upload session is already complete")
+	}
+
+	chunkNumber, err := strconv.Atoi(c.Param("chunk"))
+	if err != nil || chunkNumber < 0 || chunkNumber >= s.TotalChunks {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Chunk must be between 0 and %d", s.TotalChunks-1))
+	}
+
+	chunkHash := strings.ToLower(c.Request().Header.Get("X-Chunk-Sha256"))
+	if !validSHA256(chunkHash) {
+		return c.String(http.StatusBadRequest, "Invalid X-Chunk-Sha256")
+	}
+
+	// Write to a temporary file first so a broken request never leaves a half chunk behind
+	tmp, err := os.CreateTemp(s.Dir(), "chunk-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	expected := s.ChunkLength(chunkNumber)
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(c.Request().Body, expected+1))
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	if n != expected {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Chunk %d must be %d bytes, got %d", chunkNumber, expected, n))
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != chunkHash {
+		return c.String(http.StatusUnprocessableEntity, fmt.Sprintf("Checksum mismatch for chunk %d", chunkNumber))
+	}
+
+	if err := os.Rename(tmp.Name(), s.ChunkPath(chunkNumber)); err != nil {
+		return err
+	}
+
+	s, err = s.AddChunk(chunkNumber)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to record chunk: %s", err))
+	}
+
+	if len(s.Received) < s.TotalChunks {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"message": fmt.Sprintf("Chunk %d uploaded successfully.", chunkNumber),
+			"missing": s.Missing(),
+		})
+	}
+
+	// Only one of the requests that complete the set assembles the file
+	started, err := s.StartAssembling()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to update upload session: %s", err))
+	}
+	if !started {
+		return c.JSON(http.StatusAccepted, map[string]string{
+			"message": "Upload session is being assembled.",
+		})
+	}
+
+	// The file goes to the drive the session was started for,
+	// the grant of a session in another user's folder must still be there
+	owner, status, err := grantedOwner(usr, s.UUsername, s.Path, grant.RoleEditor)
+	if err != nil {
+		s.Delete()
+		return c.String(status, err.Error())
+	}
+
+	return assembleUploadSession(c, owner, s)
+}
+
+// Handler to abort a session, its reserved space is released.
+// A session whose file is being stored can't be aborted anymore.
+func DeleteUploadSession(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	s, err := upload.GetUploadSession(usr.Username, c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusNotFound, "Upload session not found")
+	}
+
+	err = s.Abort()
+	if err == upload.ErrSessionAssembling {
+		return c.String(http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to delete upload session: %s", err))
+	}
+
+	return c.String(http.StatusOK, "Upload session deleted.")
+}
+
+// assembleUploadSession joins the chunks in order, verifies the hash of the
+// whole file and moves it into the user's drive
+func assembleUploadSession(c echo.Context, usr *user.User, s *upload.UploadSession) error {
+	// The file is charged the reservation of the session, both count until it is deleted
+	done := user.BeginDriveChange(usr.Username)
+	defer done()
+
+	assembledPath := filepath.Join(s.Dir(), "assembled")
+	dst, err := os.Create(assembledPath)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	for n := 0; n < s.TotalChunks; n++ {
+		part, err := os.Open(s.ChunkPath(n))
+		if err != nil {
+			dst.Close()
+			s.Delete()
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to read chunk %d: %s", n, err))
+		}
+		_, err = io.Copy(io.MultiWriter(dst, hash), part)
+		part.Close()
+		if err != nil {
+			dst.Close()
+			s.Delete()
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to assemble file: %s", err))
+		}
+	}
+	dst.Close()
+
+	if hex.EncodeToString(hash.Sum(nil)) != s.SHA256 {
+		s.Delete()
+		return c.String(http.StatusUnprocessableEntity, "Checksum mismatch for the assembled file, the upload was discarded.")
+	}
+
+	fileName, err := commitUpload(usr, s.Path, s.Filename, assembledPath, s.Mode == "version", s.Reserved)
+	if err != nil {
+		s.Delete()
+		return uploadError(c, err)
+	}
+
+	// The reservation became the charge of the file
+	s.Reserved = 0
+	if err := s.Delete(); err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to delete upload session: %s", err))
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message":  fmt.Sprintf("File uploaded successfully as %s.", fileName),
+		"fileName": fileName,
+	})
+}
+
+// validSHA256 reports whether s is a hex encoded SHA-256 digest
+func validSHA256(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == sha256.Size*2
+}
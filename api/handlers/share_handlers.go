@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/share"
+	"github.com/poriamsz55/distork/api/models/user"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxShareLogs is how many accesses of a share are returned to its owner
+const maxShareLogs = 200
+
+// SharedEntry is a file or folder listed through a folder share,
+// its path is relative to the shared folder
+type SharedEntry struct {
+	Filename string    `json:"filename"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Path     string    `json:"path"`
+	IsDir    bool      `json:"is_dir"`
+}
+
+// Handler to create a share link for a file or folder of the user's drive
+func CreateShare(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	p := utils.CleanDrivePath(c.QueryParam("path"))
+	if p == "/" {
+		return c.String(http.StatusBadRequest, "The root folder can't be shared")
+	}
+
+	f, err := file.GetFile(usr.Username, p)
+	if err != nil {
+		return c.String(http.StatusNotFound, fmt.Sprintf("File %s not found.", p))
+	}
+
+	s, err := share.NewShare(usr.Username, p, f.IsDir)
+	if err != nil {
+		return err
+	}
+
+	if err := s.SetPassword(c.FormValue("password")); err != nil {
+		return err
+	}
+
+	if value := c.FormValue("expires_at"); value != "" {
+		expiresAt, err := time.Parse(time.RFC3339, value)
+		if err != nil || !expiresAt.After(time.Now()) {
+			return c.String(http.StatusBadRequest, "expires_at must be a future RFC 3339 time")
+		}
+		s.ExpiresAt = &expiresAt
+	}
+
+	if value := c.FormValue("max_downloads"); value != "" {
+		maxDownloads, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxDownloads < 0 {
+			return c.String(http.StatusBadRequest, "Invalid max_downloads")
+		}
+		s.MaxDownloads = maxDownloads
+	}
+
+	if err := s.AddShareToDB(); err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to create share: %s", err))
+	}
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"message": fmt.Sprintf("%s shared successfully.", f.Filename),
+		"share":   s,
+		"url":     "/api/s/" + s.Token,
+	})
+}
+
+// Handler to list the share links of the user
+func ListShares(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	shares, err := share.GetShares(usr.Username)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, shares)
+}
+
+// Handler to revoke a share link of the user
+func RevokeShare(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	err := share.DeleteShare(usr.Username, c.QueryParam("token"))
+	if err == mongo.ErrNoDocuments {
+		return c.String(http.StatusNotFound, "Share not found")
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to revoke share: %s", err))
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Share revoked.",
+	})
+}
+
+// Handler to list the latest accesses made with a share link of the user
+func ListShareLogs(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	logs, err := share.GetAccessLogs(usr.Username, c.QueryParam("token"), maxShareLogs)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, logs)
+}
+
+// Handler to open a share link without an account. A shared file is downloaded,
+// a shared folder is listed and the files below it are reached with ?path=.
+// The password is sent in the X-Share-Password header or the password form value.
+func OpenShare(c echo.Context) error {
+	s, err := share.GetShare(c.Param("token"))
+	if err != nil {
+		return c.String(http.StatusNotFound, "Share not found")
+	}
+
+	// Paths below a shared folder can't climb out of it
+	target := s.Path
+	if sub := utils.CleanDrivePath(c.QueryParam("path")); sub != "/" {
+		if !s.IsDir {
+			return c.String(http.StatusNotFound, "File not found")
+		}
+		target = path.Join(s.Path, sub)
+	}
+
+	logAccess := func(action string, status int) {
+		(&share.AccessLog{
+			Token:     s.Token,
+			UUsername: s.UUsername,
+			Path:      sharedPath(s, target),
+			IP:        c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+			Action:    action,
+			Status:    status,
+			Time:      time.Now(),
+		}).AddAccessLogToDB()
+	}
+
+	if s.Expired(time.Now()) {
+		logAccess("open", http.StatusGone)
+		return c.String(http.StatusGone, "Share expired")
+	}
+
+	password := c.Request().Header.Get("X-Share-Password")
+	if password == "" {
+		password = c.FormValue("password")
+	}
+	if !s.CheckPassword(password) {
+		logAccess("open", http.StatusUnauthorized)
+		return c.String(http.StatusUnauthorized, "Invalid password")
+	}
+
+	f, err := file.GetFile(s.UUsername, target)
+	if err != nil {
+		logAccess("open", http.StatusNotFound)
+		return c.String(http.StatusNotFound, "File not found")
+	}
+
+	if f.IsDir {
+		files, err := file.GetFilesByDir(s.UUsername, target)
+		if err != nil {
+			return err
+		}
+
+		entries := make([]SharedEntry, 0, len(files))
+		for _, f := range files {
+			entries = append(entries, SharedEntry{
+				Filename: f.Filename,
+				Size:     f.Size,
+				ModTime:  f.ModTime,
+				Path:     sharedPath(s, f.Path),
+				IsDir:    f.IsDir,
+			})
+		}
+
+		logAccess("list", http.StatusOK)
+		return c.JSON(http.StatusOK, entries)
+	}
+
+	// Asking for the headers doesn't use up the link
+	if c.Request().Method == http.MethodHead {
+		logAccess("download", http.StatusOK)
+		return streamFile(c, f.ContentKey(), f.Filename, f.ContentType(), f.Hash)
+	}
+
+	// Every transfer uses up a download, except a client resuming one that
+	// was counted from where it stopped. Any byte is served once per download.
+	ip, version := c.RealIP(), contentVersion(f)
+	start, resumable := resumeStart(c.Request(), f)
+	resumed := false
+	if resumable {
+		resumed, err = s.UseResume(ip, target, version, start)
+		if err != nil {
+			return err
+		}
+	}
+	if !resumed {
+		ok, err := s.CountDownload()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			logAccess("download", http.StatusGone)
+			return c.String(http.StatusGone, "Download limit reached")
+		}
+	}
+
+	logAccess("download", http.StatusOK)
+	if err := streamFile(c, f.ContentKey(), f.Filename, f.ContentType(), f.Hash); err != nil {
+		return err
+	}
+
+	// Remember how far the client got, so it can resume from there
+	res := c.Response()
+	switch {
+	case res.Status == http.StatusOK:
+		start = 0
+	case res.Status != http.StatusPartialContent || !resumable:
+		return nil
+	}
+	if next := start + res.Size; res.Size > 0 && next < f.Size {
+		return s.AddResume(ip, target, version, next)
+	}
+	return nil
+}
+
+// contentVersion identifies the content of f, a resume of another content starts over
+func contentVersion(f *file.File) string {
+	if f.Hash != "" {
+		return f.Hash
+	}
+	return fmt.Sprintf("%d-%d", f.Size, f.ModTime.UnixNano())
+}
+
+// resumeStart returns where the range asked for by r starts when it may
+// resume a download of f: a single range, of the same content when it
+// comes with If-Range. Anything else is a new download.
+func resumeStart(r *http.Request, f *file.File) (int64, bool) {
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && (f.Hash == "" || ifRange != hashETag(f.Hash)) {
+		return 0, false
+	}
+
+	spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, false
+	}
+	first, _, ok := strings.Cut(spec, "-")
+	start, err := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+	if !ok || err != nil || start < 0 {
+		return 0, false
+	}
+	return start, true
+}
+
+// sharedPath returns p relative to the root of the share, a shared file is "/"
+func sharedPath(s *share.Share, p string) string {
+	return utils.CleanDrivePath(strings.TrimPrefix(p, s.Path))
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/poriamsz55/distork/api/models/file"
+)
+
+func Test_resumeStart(t *testing.T) {
+	hash := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	f := &file.File{Size: 100, Hash: hash}
+
+	tests := []struct {
+		rangeHeader, ifRange string
+		start                int64
+		resumable            bool
+	}{
+		{"", "", 0, false},
+		{"bytes=0-", "", 0, true},
+		{"bytes=40-", "", 40, true},
+		{"bytes=40-59", hashETag(hash), 40, true},
+		{"bytes=40-", `"other"`, 0, false},
+		{"bytes=1-,0-0", "", 0, false},
+		{"bytes=-10", "", 0, false},
+		{"items=4-", "", 0, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/s/token", nil)
+		req.Header.Set("Range", tt.rangeHeader)
+		if tt.ifRange != "" {
+			req.Header.Set("If-Range", tt.ifRange)
+		}
+
+		start, resumable := resumeStart(req, f)
+		if start != tt.start || resumable != tt.resumable {
+			t.Errorf("resumeStart(%q, %q) = %d, %v, want %d, %v",
+				tt.rangeHeader, tt.ifRange, start, resumable, tt.start, tt.resumable)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/grant"
+	"github.com/poriamsz55/distork/api/models/thumb"
+	"github.com/poriamsz55/distork/api/models/user"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/storage"
+	"github.com/poriamsz55/distork/utils"
+)
+
+// Handler to get a JPEG thumbnail of an image: ?path=/photos/a.png&size=256.
+// Thumbnails are made on the first request and cached for every later one.
+func GetThumbnail(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	size, err := strconv.Atoi(c.QueryParam("size"))
+	if err != nil || !validThumbnailSize(size) {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Thumbnail size must be one of %v", config.ThumbnailSizes))
+	}
+
+	p := utils.CleanDrivePath(c.QueryParam("path"))
+
+	// Images shared by another user are shown with ?owner=
+	usr, status, err := driveOwner(c, usr, p, grant.RoleViewer)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	f, err := file.GetFile(usr.Username, p)
+	if err != nil || f.IsDir {
+		return c.String(http.StatusNotFound, "File not found")
+	}
+	if !utils.IsImageName(f.Filename) {
+		return c.String(http.StatusBadRequest, "Thumbnails are only made of JPEG, PNG, GIF and WebP images")
+	}
+
+	// The content of a hashed file never changes, so its thumbnail is cached
+	// under the hash and shared by every copy. Files stored before
+	// deduplication have no hash and are thumbnailed on every request.
+	etag := fmt.Sprintf("\"%s-%d\"", f.Hash, size)
+	if f.Hash == "" {
+		etag = fmt.Sprintf("\"%x-%x-%d\"", f.ModTime.UnixNano(), f.Size, size)
+	}
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set(echo.HeaderCacheControl, "private, max-age=86400")
+	for _, match := range strings.Split(c.Request().Header.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(match) == etag {
+			return c.NoContent(http.StatusNotModified)
+		}
+	}
+
+	if f.Hash != "" {
+		if t, err := thumb.GetThumb(f.Hash, size); err == nil {
+			return c.Blob(http.StatusOK, "image/jpeg", t.Data)
+		}
+	}
+
+	r, err := storage.GetStorage().Get(c.Request().Context(), f.ContentKey(), 0, -1)
+	if err == storage.ErrNotExist {
+		return c.String(http.StatusNotFound, "File not found")
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	data, err := utils.MakeThumbnail(r, size)
+	if err != nil {
+		return c.String(http.StatusUnprocessableEntity, fmt.Sprintf("Failed to make a thumbnail: %s", err))
+	}
+
+	if f.Hash != "" {
+		// A failed cache only costs the next request another decode
+		thumb.NewThumb(f.Hash, size, data).AddThumbToDB()
+	}
+
+	return c.Blob(http.StatusOK, "image/jpeg", data)
+}
+
+func validThumbnailSize(size int) bool {
+	for _, s := range config.ThumbnailSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// addThumbnailURLs fills the thumbnail URLs of the images in files. owner is
+// set when the files are listed from the drive of another user.
+func addThumbnailURLs(files []file.File, owner string) {
+	for i := range files {
+		f := &files[i]
+		if f.IsDir || !utils.IsImageName(f.Filename) {
+			continue
+		}
+
+		query := url.Values{"path": {f.Path}}
+		if owner != "" {
+			query.Set("owner", owner)
+		}
+
+		f.Thumbnails = map[string]string{}
+		for _, size := range config.ThumbnailSizes {
+			query.Set("size", strconv.Itoa(size))
+			f.Thumbnails[strconv.Itoa(size)] = "/api/drive/thumbnail?" + query.Encode()
+		}
+	}
+}
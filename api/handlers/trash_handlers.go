@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/trash"
+	"github.com/poriamsz55/distork/api/models/user"
+	"github.com/poriamsz55/distork/api/models/version"
+	"github.com/poriamsz55/distork/storage"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Handler to list the items in the user's trash
+func ListTrash(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	items, err := trash.GetTrashItems(usr.Username)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, items)
+}
+
+// Handler to put a trashed item back at its original path
+func RestoreTrash(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	done := user.BeginDriveChange(usr.Username)
+	defer done()
+
+	// The item leaves the trash before anything is restored, a concurrent
+	// restore or purge of it finds nothing to do
+	item, err := trash.TakeTrashItem(usr.Username, c.QueryParam("id"))
+	if err == mongo.ErrNoDocuments {
+		return c.String(http.StatusNotFound, "Trash item not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	// Until its content is moved, a failed restore puts the item back
+	putBack := func() {
+		item.AddTrashItemToDB()
+	}
+
+	// Recreate the parent folder if it was deleted in the meantime
+	parent := path.Dir(item.OrigPath)
+	if err := file.EnsureDirs(usr.Username, parent); err != nil {
+		putBack()
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to index folder: %s", err))
+	}
+
+	// Don't overwrite anything created at the original path since the delete
+	var restorePath string
+	copyCount := 0
+	for {
+		restorePath = path.Join(parent, utils.SanitizeFileName(item.Filename, copyCount))
+		if _, err := file.GetFile(usr.Username, restorePath); err == nil {
+			copyCount++
+		} else {
+			break
+		}
+	}
+
+	// Empty folders only exist in the index, there is nothing to move for them
+	err = storage.GetStorage().Move(c.Request().Context(),
+		trash.ItemKey(usr.Username, item.TrashId), utils.DriveKey(usr.Username, restorePath))
+	if err != nil && err != storage.ErrNotExist {
+		putBack()
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to restore: %s", err))
+	}
+
+	for _, f := range item.Files {
+		restored := file.NewFile(usr.Username, restorePath+strings.TrimPrefix(f.Path, item.OrigPath), f.Size, f.ModTime, f.IsDir)
+		restored.Hash = f.Hash
+		restored.MimeType = f.MimeType
+		if err := restored.AddFileToDB(); err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to index file: %s", err))
+		}
+	}
+
+	if err := version.RestoreVersions(usr.Username, item.TrashId, item.OrigPath, restorePath); err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to restore versions: %s", err))
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("%s restored successfully.", item.Filename),
+		"path":    restorePath,
+	})
+}
+
+// Handler to permanently delete one trashed item, or the whole trash when no id is given
+func EmptyTrash(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	var items []trash.TrashItem
+	if id := c.QueryParam("id"); id != "" {
+		item, err := trash.GetTrashItem(usr.Username, id)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Trash item not found")
+		}
+		items = append(items, *item)
+	} else {
+		var err error
+		items, err = trash.GetTrashItems(usr.Username)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Items restored or purged by another request meanwhile are left to it
+	var freed int64
+	purged := 0
+	for _, item := range items {
+		err := item.Purge()
+		if err == trash.ErrItemTaken {
+			if c.QueryParam("id") != "" {
+				return c.String(http.StatusConflict, err.Error())
+			}
+			continue
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to purge %s: %s", item.Filename, err))
+		}
+		freed += item.Size
+		purged++
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("%d items deleted permanently.", purged),
+		"freed":   freed,
+	})
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/blob"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/user"
+	"github.com/poriamsz55/distork/storage"
+)
+
+// trashTestFile stores a file in the drive of alice and moves it to the trash,
+// it returns the id of the trash item and the hash of its content
+func trashTestFile(t *testing.T) (string, string) {
+	connectTestDB(t)
+	t.Setenv("DISTORK_STORAGE", "local")
+	t.Setenv("DISTORK_LOCAL_ROOT", t.TempDir())
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	usr := &user.User{Username: "alice", Role: "user", DriveSize: 1000, DriveUsed: 10}
+	if err := usr.AddUserToDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("0123456789"))
+	hash := hex.EncodeToString(sum[:])
+	if _, err := blob.Store(context.Background(), hash, strings.NewReader("0123456789"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexFile("alice", "/", "a.txt", 10, hash, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := file.GetTree("alice", "/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := trashTree(context.Background(), usr, "/a.txt", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return item.TrashId, hash
+}
+
+// serveTrash runs handler for alice and returns the status it answered
+func serveTrash(t *testing.T, handler echo.HandlerFunc, method, target string) int {
+	usr, err := user.GetUserByUsername("alice")
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(method, target, nil), rec)
+	c.Set("user", &usr)
+	if err := handler(c); err != nil {
+		t.Error(err)
+	}
+	return rec.Code
+}
+
+// blobRefs returns the references recorded for hash, 0 when the blob is gone
+func blobRefs(t *testing.T, hash string) int64 {
+	blobs, err := blob.GetBlobsAfter("", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blobs {
+		if b.Hash == hash {
+			return b.Refs
+		}
+	}
+	return 0
+}
+
+func TestRestoreTrash_concurrent(t *testing.T) {
+	id, hash := trashTestFile(t)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 5)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = serveTrash(t, RestoreTrash, http.MethodPost, "/api/trash/restore?id="+id)
+		}(i)
+	}
+	wg.Wait()
+
+	restored := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			restored++
+		case http.StatusNotFound:
+		default:
+			t.Errorf("restore answered %d", code)
+		}
+	}
+	if restored != 1 {
+		t.Fatalf("the item was restored %d times", restored)
+	}
+
+	files, err := file.GetFilesByHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Path != "/a.txt" {
+		t.Errorf("files holding the content = %+v, want /a.txt only", files)
+	}
+	if refs := blobRefs(t, hash); refs != 1 {
+		t.Errorf("blob references = %d, want 1", refs)
+	}
+}
+
+func TestRestoreTrash_whilePurged(t *testing.T) {
+	id, hash := trashTestFile(t)
+
+	var wg sync.WaitGroup
+	var restoreCode, purgeCode int
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		restoreCode = serveTrash(t, RestoreTrash, http.MethodPost, "/api/trash/restore?id="+id)
+	}()
+	go func() {
+		defer wg.Done()
+		purgeCode = serveTrash(t, EmptyTrash, http.MethodDelete, "/api/trash?id="+id)
+	}()
+	wg.Wait()
+
+	files, err := file.GetFilesByHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := blobRefs(t, hash)
+
+	// Whichever came first, the other one found nothing to do
+	switch {
+	case restoreCode == http.StatusOK && purgeCode != http.StatusOK:
+		if len(files) != 1 || refs != 1 {
+			t.Errorf("restored: %d files, %d references, want 1 and 1", len(files), refs)
+		}
+	case purgeCode == http.StatusOK && restoreCode == http.StatusNotFound:
+		if len(files) != 0 || refs != 0 {
+			t.Errorf("purged: %d files, %d references, want none", len(files), refs)
+		}
+	default:
+		t.Errorf("restore answered %d and purge %d", restoreCode, purgeCode)
+	}
+}
@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/grant"
+	"github.com/poriamsz55/distork/api/models/upload"
+	"github.com/poriamsz55/distork/api/models/user"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/utils"
+)
+
+// Handlers of the tus 1.0.0 resumable upload protocol, see https://tus.io/protocols/resumable-upload
+
+const (
+	tusExtensions  = "creation,creation-with-upload,termination,expiration"
+	tusContentType = "application/offset+octet-stream"
+)
+
+// Handler for the tus discovery request. Tus-Max-Size is the largest upload
+// the server takes, an upload that doesn't fit the drive is refused when it is created.
+func TusOptions(c echo.Context) error {
+	c.Response().Header().Set("Tus-Extension", tusExtensions)
+	c.Response().Header().Set("Tus-Max-Size", strconv.FormatInt(config.GetConfigDrive().TusMaxSize, 10))
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Handler to create a new tus upload. The file name, target folder and
+// upload mode are taken from the "filename", "path" and "mode" metadata.
+func TusCreate(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	if c.Request().Header.Get("Upload-Defer-Length") != "" {
+		return c.String(http.StatusBadRequest, "Upload-Defer-Length is not supported")
+	}
+
+	length, err := strconv.ParseInt(c.Request().Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return c.String(http.StatusBadRequest, "Invalid Upload-Length")
+	}
+	if maxSize := config.GetConfigDrive().TusMaxSize; length > maxSize {
+		return c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("Uploads are limited to %d bytes", maxSize))
+	}
+
+	metadata, err := parseTusMetadata(c.Request().Header.Get("Upload-Metadata"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid Upload-Metadata: %s", err))
+	}
+
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	filename = filepath.Base(filename)
+	if !validName(filename) {
+		return c.String(http.StatusBadRequest, "Missing filename in Upload-Metadata")
+	}
+
+	dir := metadata["path"]
+	if dir == "" {
+		dir = c.QueryParam("path")
+	}
+
+	// Uploads into a folder shared by another user go to the
+	// owner's drive and count against the owner's quota
+	owner, status, err := driveOwner(c, usr, dir, grant.RoleEditor)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	// Reserve the whole length before accepting any bytes, so parallel
+	// uploads can't each stream more than the drive has left
+	done := user.BeginDriveChange(owner.Username)
+	defer done()
+
+	err = reserveSpace(owner, length)
+	if err == errInsufficientSpace {
+		return c.String(http.StatusRequestEntityTooLarge, "Insufficient drive space.")
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to update drive usage: %s", err))
+	}
+
+	t := upload.NewTusUpload(owner.Username, dir, filename, length, metadata)
+	t.Reserved = length
+
+	// A PATCH sent as soon as the upload is recorded waits for the first bytes
+	unlock := upload.LockTusUpload(t.UploadId)
+	defer unlock()
+
+	if owner != usr {
+		t.Uploader = usr.Username
+	}
+	if err := os.MkdirAll(filepath.Dir(t.DataPath()), os.ModePerm); err != nil {
+		releaseSpace(owner, length)
+		return err
+	}
+
+	data, err := os.Create(t.DataPath())
+	if err != nil {
+		releaseSpace(owner, length)
+		return err
+	}
+	data.Close()
+
+	if err := t.AddTusUploadToDB(); err != nil {
+		releaseSpace(owner, length)
+		os.Remove(t.DataPath())
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to create upload: %s", err))
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, strings.TrimSuffix(c.Request().URL.Path, "/")+"/"+t.UploadId)
+	c.Response().Header().Set("Upload-Expires", t.ExpiresAt.UTC().Format(http.TimeFormat))
+
+	// creation-with-upload: the body may already carry the first bytes
+	if c.Request().Header.Get(echo.HeaderContentType) == tusContentType {
+		status, err := writeTusData(c, usr, t)
+		if err != nil {
+			return c.String(status, err.Error())
+		}
+		c.Response().Header().Set("Upload-Offset", strconv.FormatInt(t.Offset, 10))
+	} else if t.Length == 0 {
+		if status, err := finishTusUpload(usr, t); err != nil {
+			return c.String(status, err.Error())
+		}
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
+
+// Handler to ask how many bytes of an upload the server has
+func TusHead(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	t, err := upload.GetTusUpload(usr.Username, c.Param("id"))
+	if err != nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	c.Response().Header().Set("Upload-Offset", strconv.FormatInt(t.Offset, 10))
+	c.Response().Header().Set("Upload-Length", strconv.FormatInt(t.Length, 10))
+	c.Response().Header().Set("Upload-Expires", t.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	return c.NoContent(http.StatusOK)
+}
+
+// Handler to append bytes to an upload at the given offset
+func TusPatch(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	if c.Request().Header.Get(echo.HeaderContentType) != tusContentType {
+		return c.String(http.StatusUnsupportedMediaType, "Content-Type must be "+tusContentType)
+	}
+
+	offset, err := strconv.ParseInt(c.Request().Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return c.String(http.StatusBadRequest, "Invalid Upload-Offset")
+	}
+
+	id := c.Param("id")
+	unlock := upload.LockTusUpload(id)
+	defer unlock()
+
+	t, err := upload.GetTusUpload(usr.Username, id)
+	if err != nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	if offset != t.Offset {
+		return c.String(http.StatusConflict, fmt.Sprintf("Upload-Offset should be %d", t.Offset))
+	}
+
+	status, err := writeTusData(c, usr, t)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	c.Response().Header().Set("Upload-Offset", strconv.FormatInt(t.Offset, 10))
+	c.Response().Header().Set("Upload-Expires", t.ExpiresAt.UTC().Format(http.TimeFormat))
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Handler for the termination extension, it drops an unfinished upload
+// and releases the space it reserved
+func TusDelete(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	// Wait for a PATCH storing the upload to be done with it
+	id := c.Param("id")
+	unlock := upload.LockTusUpload(id)
+	defer unlock()
+
+	t, err := upload.GetTusUpload(usr.Username, id)
+	if err != nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	if err := t.Delete(); err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to delete upload: %s", err))
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// writeTusData appends the request body to the upload and moves the file
+// into the drive once every byte has arrived
+func writeTusData(c echo.Context, usr *user.User, t *upload.TusUpload) (int, error) {
+	data, err := os.OpenFile(t.DataPath(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Keep whatever arrived, even if the connection drops in the middle
+	n, copyErr := io.Copy(data, io.LimitReader(c.Request().Body, t.Length-t.Offset))
+	data.Close()
+
+	if err := t.SetOffset(t.Offset + n); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if copyErr != nil {
+		return http.StatusInternalServerError, copyErr
+	}
+
+	if t.Offset == t.Length {
+		return finishTusUpload(usr, t)
+	}
+	return http.StatusOK, nil
+}
+
+// finishTusUpload stores a complete upload in the drive it was created for,
+// the grant of an upload into another user's folder must still be there
+func finishTusUpload(usr *user.User, t *upload.TusUpload) (int, error) {
+	owner, status, err := grantedOwner(usr, t.UUsername, t.Path, grant.RoleEditor)
+	if err != nil {
+		return status, err
+	}
+
+	// The file is charged the reservation of the upload, both count until it is deleted
+	done := user.BeginDriveChange(owner.Username)
+	defer done()
+
+	_, err = commitUpload(owner, t.Path, t.Filename, t.DataPath(), t.Metadata["mode"] == "version", t.Reserved)
+	// The quarantine keeps a copy of an infected upload, an upload too
+	// large to be scanned is refused for good
+	if errors.Is(err, errInfected) || errors.Is(err, errScanTooLarge) {
+		t.Delete()
+		return uploadStatus(err), err
+	}
+	if err != nil {
+		return uploadStatus(err), err
+	}
+
+	// The reservation became the charge of the file
+	t.Reserved = 0
+	if err := t.Delete(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated
+// pairs of a key and an optional base64 encoded value
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		switch len(fields) {
+		case 1:
+			metadata[fields[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			metadata[fields[0]] = string(value)
+		default:
+			return nil, fmt.Errorf("malformed pair %q", pair)
+		}
+	}
+
+	if p, ok := metadata["path"]; ok {
+		metadata["path"] = utils.CleanDrivePath(p)
+	}
+	return metadata, nil
+}
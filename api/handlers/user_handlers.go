@@ -4,13 +4,13 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"os"
-	"path/filepath"
 
 	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/file"
 	"github.com/poriamsz55/distork/api/models/user"
 	config "github.com/poriamsz55/distork/configs"
 	"github.com/poriamsz55/distork/database"
+	"github.com/poriamsz55/distork/storage"
 	"github.com/poriamsz55/distork/utils"
 	"go.mongodb.org/mongo-driver/bson"
 )
@@ -82,14 +82,23 @@ func SignUp(c echo.Context) error {
 		}
 
 		// rename upload folder ip@mail.com to user.email...
-		err = os.Rename(filepath.Join(config.GetConfigDrive().UploadDir, c.RealIP()),
-			filepath.Join(config.GetConfigDrive().UploadDir, newUser.Username))
-		if err != nil {
+		// a guest that never uploaded anything has no folder to rename
+		err = storage.GetStorage().Move(context.Background(),
+			utils.DriveKey(c.RealIP(), "/"), utils.DriveKey(newUser.Username, "/"))
+		if err != nil && err != storage.ErrNotExist {
 			return c.JSON(http.StatusBadRequest, map[string]string{
 				"message": "Couldn't rename directory",
 			})
 		}
 
+		// move the guest's indexed files to the new owner
+		err = file.RenameOwner(c.RealIP(), newUser.Username)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Couldn't move drive files",
+			})
+		}
+
 		return c.JSON(http.StatusCreated, map[string]interface{}{
 			"message":  "User created successfully",
 			"token":    token,
@@ -105,12 +114,6 @@ func SignUp(c echo.Context) error {
 		})
 	}
 
-	// Create user-specific directory if not exists
-	userDir := filepath.Join(config.GetConfigDrive().UploadDir, newUser.Username)
-	if err := os.MkdirAll(userDir, os.ModePerm); err != nil {
-		return err
-	}
-
 	newUser.Password = ""
 	return c.JSON(http.StatusCreated, map[string]interface{}{
 		"message":  "User created successfully",
@@ -196,17 +199,6 @@ func NewGuest(c echo.Context) error {
 		})
 	}
 
-	// Create upload directory if it doesn't exist
-	_, err = os.Stat(filepath.Join(config.GetConfigDrive().UploadDir, c.RealIP()))
-
-	if os.IsNotExist(err) {
-		if os.MkdirAll(filepath.Join(config.GetConfigDrive().UploadDir, c.RealIP()), os.ModePerm) != nil {
-			return c.JSON(http.StatusOK, map[string]interface{}{
-				"message": "Coludn't create directory",
-			})
-		}
-	}
-
 	// Send the token in response (no cookie needed)
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"message": "Login successful",
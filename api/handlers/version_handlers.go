@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/grant"
+	"github.com/poriamsz55/distork/api/models/user"
+	"github.com/poriamsz55/distork/api/models/version"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/storage"
+	"github.com/poriamsz55/distork/utils"
+)
+
+// Handler to list the previous versions of a file
+func ListVersions(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	filePath := utils.CleanDrivePath(c.QueryParam("path"))
+	usr, status, err := driveOwner(c, usr, filePath, grant.RoleViewer)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	versions, err := version.GetVersions(usr.Username, filePath)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, versions)
+}
+
+// Handler to download a previous version of a file
+func DownloadVersion(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	filePath := utils.CleanDrivePath(c.QueryParam("path"))
+	usr, status, err := driveOwner(c, usr, filePath, grant.RoleViewer)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	v, err := version.GetVersion(usr.Username, filePath, c.QueryParam("id"))
+	if err != nil {
+		return c.String(http.StatusNotFound, "Version not found")
+	}
+
+	mimeType := v.MimeType
+	if mimeType == "" {
+		mimeType = utils.DetectMimeType(v.Path, nil)
+	}
+	return streamFile(c, v.ContentKey(), path.Base(v.Path), mimeType, v.Hash)
+}
+
+// Handler to make a previous version the current content of a file.
+// The content it replaces is kept as a new version.
+func RestoreVersion(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	filePath := utils.CleanDrivePath(c.QueryParam("path"))
+	usr, status, err := driveOwner(c, usr, filePath, grant.RoleEditor)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	v, err := version.GetVersion(usr.Username, filePath, c.QueryParam("id"))
+	if err != nil {
+		return c.String(http.StatusNotFound, "Version not found")
+	}
+
+	done := user.BeginDriveChange(usr.Username)
+	defer done()
+
+	// The current content becomes a version, so the quota doesn't change
+	if _, err := keepVersion(usr, filePath); err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to keep current version: %s", err))
+	}
+
+	// A version kept as a blob hands its reference over to the file
+	if v.Hash == "" {
+		err = storage.GetStorage().Move(c.Request().Context(),
+			version.VersionKey(usr.Username, v.VersionId), utils.DriveKey(usr.Username, filePath))
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to restore version: %s", err))
+		}
+	}
+
+	if err := v.DeleteVersionFromDB(); err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to update versions: %s", err))
+	}
+
+	if err := file.EnsureDirs(usr.Username, path.Dir(filePath)); err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to index file: %s", err))
+	}
+	restored := file.NewFile(usr.Username, filePath, v.Size, time.Now(), false)
+	restored.Hash = v.Hash
+	restored.MimeType = v.MimeType
+	if err := restored.AddFileToDB(); err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to index file: %s", err))
+	}
+
+	if err := pruneVersions(usr, filePath); err != nil {
+		return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to prune versions: %s", err))
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("%s restored to the version of %s.", path.Base(filePath), v.ModTime.Format(time.RFC3339)),
+		"path":    filePath,
+	})
+}
+
+// uploadDestination picks the name an upload into dir is stored under. With
+// keepVersions an existing file of the same name is moved to its versions
+// instead of the upload getting a "name (1)" copy.
+func uploadDestination(usr *user.User, dir, name string, keepVersions bool) (string, *version.Version, error) {
+	if keepVersions {
+		dstName := utils.SanitizeFileName(name, 0)
+		v, err := keepVersion(usr, path.Join(dir, dstName))
+		return dstName, v, err
+	}
+
+	var dstName string
+	copyCount := 0
+	for {
+		dstName = utils.SanitizeFileName(name, copyCount)
+		// Rename the destination file if it exists
+		if _, err := file.GetFile(usr.Username, path.Join(dir, dstName)); err == nil {
+			copyCount++
+		} else {
+			break
+		}
+	}
+	return dstName, nil, nil
+}
+
+// keepVersion moves the current content of p to a new version. Content kept
+// as a blob stays where it is, the version takes over the file's reference.
+// It returns nil when there is no file at p.
+func keepVersion(usr *user.User, p string) (*version.Version, error) {
+	current, err := file.GetFile(usr.Username, p)
+	if err != nil || current.IsDir {
+		return nil, nil
+	}
+
+	v := version.NewVersion(usr.Username, p, current.Size, current.ModTime, current.Hash)
+	v.MimeType = current.MimeType
+	if v.Hash != "" {
+		if err := v.AddVersionToDB(); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+
+	key := utils.DriveKey(usr.Username, p)
+	versionKey := version.VersionKey(usr.Username, v.VersionId)
+	if err := storage.GetStorage().Move(context.Background(), key, versionKey); err != nil {
+		return nil, err
+	}
+
+	if err := v.AddVersionToDB(); err != nil {
+		storage.GetStorage().Move(context.Background(), versionKey, key)
+		return nil, err
+	}
+	return v, nil
+}
+
+// undoVersion puts the content kept by keepVersion back at the drive path p
+// when the upload replacing it failed
+func undoVersion(usr *user.User, p string, v *version.Version) {
+	if v == nil {
+		return
+	}
+
+	// The file entry still refers to the blob, only the version goes away
+	if v.Hash == "" {
+		err := storage.GetStorage().Move(context.Background(),
+			version.VersionKey(usr.Username, v.VersionId), utils.DriveKey(usr.Username, p))
+		if err != nil {
+			return
+		}
+	}
+	v.DeleteVersionFromDB()
+}
+
+// pruneVersions deletes the oldest versions of p over the limit of the user's role
+func pruneVersions(usr *user.User, p string) error {
+	done := user.BeginDriveChange(usr.Username)
+	defer done()
+
+	versions, err := version.GetVersions(usr.Username, p)
+	if err != nil {
+		return err
+	}
+
+	maxVersions := config.RoleMaxVersions[usr.Role]
+	if len(versions) <= maxVersions {
+		return nil
+	}
+
+	// versions are sorted newest first
+	var freed int64
+	for _, v := range versions[maxVersions:] {
+		n, err := v.Delete()
+		if err != nil {
+			return err
+		}
+		freed += n
+	}
+
+	usr.DriveUsed -= freed
+	return user.IncDriveUsed(usr.Username, -freed)
+}
+
+// deleteVersions removes the versions of p and of every file below it
+func deleteVersions(usr *user.User, p string) error {
+	done := user.BeginDriveChange(usr.Username)
+	defer done()
+
+	versions, err := version.GetTreeVersions(usr.Username, p)
+	if err != nil {
+		return err
+	}
+
+	var freed int64
+	for _, v := range versions {
+		n, err := v.Delete()
+		if err != nil {
+			return err
+		}
+		freed += n
+	}
+
+	usr.DriveUsed -= freed
+	return user.IncDriveUsed(usr.Username, -freed)
+}
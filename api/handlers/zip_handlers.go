@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/grant"
+	"github.com/poriamsz55/distork/api/models/user"
+	"github.com/poriamsz55/distork/storage"
+	"github.com/poriamsz55/distork/utils"
+)
+
+// Handler to download several files and folders as one ZIP archive, every
+// path parameter is added with everything inside it: ?path=/a&path=/b/c.txt
+func DownloadZip(c echo.Context) error {
+	usr := c.Get("user").(*user.User)
+
+	paths := c.QueryParams()["path"]
+	if len(paths) == 0 {
+		return c.String(http.StatusBadRequest, "No path to download")
+	}
+
+	// Items shared by another user are downloaded with ?owner=, the
+	// caller needs access to every one of them
+	owner := usr
+	for i, p := range paths {
+		paths[i] = utils.CleanDrivePath(p)
+
+		var status int
+		var err error
+		owner, status, err = driveOwner(c, usr, paths[i], grant.RoleViewer)
+		if err != nil {
+			return c.String(status, err.Error())
+		}
+	}
+
+	paths = outermostPaths(paths)
+
+	name := "download"
+	if len(paths) == 1 {
+		name = path.Base(paths[0])
+		if paths[0] == "/" {
+			name = owner.Username
+		}
+	}
+
+	return streamZip(c, owner.Username, paths, name+".zip")
+}
+
+// streamZip writes the trees of the drive paths to the response as a ZIP archive
+// called name. Nothing is buffered: entries are compressed while they are sent,
+// and zip64 records are used when the archive outgrows the classic format.
+func streamZip(c echo.Context, username string, paths []string, name string) error {
+	// Collect every tree first, so a missing path is still answered with an error status
+	trees := make([][]file.File, 0, len(paths))
+	for _, p := range paths {
+		tree, err := file.GetTree(username, p)
+		if err != nil {
+			return err
+		}
+		if len(tree) == 0 && p != "/" {
+			return c.String(http.StatusNotFound, fmt.Sprintf("File %s not found.", p))
+		}
+		trees = append(trees, tree)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	c.Response().Header().Set(echo.HeaderContentType, "application/zip")
+	c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+	c.Response().WriteHeader(http.StatusOK)
+
+	zw := zip.NewWriter(c.Response())
+	ctx := c.Request().Context()
+	st := storage.GetStorage()
+
+	used := map[string]bool{}
+	for i, tree := range trees {
+		root := paths[i]
+
+		// Entries are named below the base name of their selected path,
+		// two selections with the same base name get a "name (1)" copy
+		prefix := ""
+		if root != "/" {
+			prefix = path.Base(root)
+			for copyCount := 1; used[prefix]; copyCount++ {
+				prefix = utils.SanitizeFileName(path.Base(root), copyCount)
+			}
+			used[prefix] = true
+		}
+
+		for _, f := range tree {
+			entryName := strings.TrimPrefix(path.Join(prefix, strings.TrimPrefix(f.Path, root)), "/")
+			if entryName == "" {
+				continue
+			}
+
+			if err := addZipEntry(ctx, st, zw, &f, entryName); err != nil {
+				// The status is already sent, all that can be done is to cut the archive short
+				log.Printf("ZIP download of %s for %s failed: %s", f.Path, username, err)
+				return nil
+			}
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		log.Printf("ZIP download for %s failed: %s", username, err)
+	}
+	return nil
+}
+
+// addZipEntry adds a file, or an empty entry for a folder, to the archive
+func addZipEntry(ctx context.Context, st storage.Storage, zw *zip.Writer, f *file.File, name string) error {
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: f.ModTime,
+	}
+	if f.IsDir {
+		header.Name += "/"
+		header.Method = zip.Store
+		_, err := zw.CreateHeader(header)
+		return err
+	}
+
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	r, err := st.Get(ctx, f.ContentKey(), 0, -1)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// outermostPaths drops the paths that are inside another one of paths, or repeated
+func outermostPaths(paths []string) []string {
+	outer := []string{}
+	for i, p := range paths {
+		inside := false
+		for j, other := range paths {
+			if i == j {
+				continue
+			}
+			if p == other && j < i || p != other && (other == "/" || strings.HasPrefix(p, other+"/")) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			outer = append(outer, p)
+		}
+	}
+	return outer
+}
@@ -0,0 +1,268 @@
+package jobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/poriamsz55/distork/api/models/blob"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/storage"
+	"github.com/poriamsz55/distork/utils"
+)
+
+// maxScrubReports is how many reports are kept for the admin
+const maxScrubReports = 20
+
+// scrubPageSize is how many blobs are read from the index at a time
+const scrubPageSize = 500
+
+// ScrubFile is a drive file holding damaged or missing content
+type ScrubFile struct {
+	Owner string `json:"owner"`
+	Path  string `json:"path"`
+}
+
+// ScrubIssue is stored content that doesn't match its checksum or is gone
+type ScrubIssue struct {
+	Key    string      `json:"key"`
+	Hash   string      `json:"hash,omitempty"`   // recorded at upload, empty for files stored before deduplication
+	Size   int64       `json:"size"`             // recorded at upload
+	Actual string      `json:"actual,omitempty"` // SHA-256 of what was read back
+	Read   int64       `json:"read"`             // bytes found in the storage
+	Error  string      `json:"error,omitempty"`  // why the content couldn't be read
+	Files  []ScrubFile `json:"files,omitempty"`
+}
+
+// ScrubReport describes one run of the integrity scrubber, the report of a
+// run in progress shows what was found so far
+type ScrubReport struct {
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt time.Time    `json:"finished_at"`
+	Running    bool         `json:"running"`
+	Checked    int          `json:"checked"` // contents read back and hashed
+	Bytes      int64        `json:"bytes"`
+	Mismatched []ScrubIssue `json:"mismatched"`
+	Missing    []ScrubIssue `json:"missing"`
+	Unverified int          `json:"unverified"` // files stored before deduplication, only checked to exist
+	Errors     []string     `json:"errors,omitempty"`
+}
+
+var scrubber struct {
+	sync.Mutex
+	run     sync.Mutex
+	running *ScrubReport // the run in progress
+	reports []ScrubReport
+}
+
+// RunIntegrityScrubber periodically reads every stored content back and
+// checks it against its checksum. Scrubbing reads the whole storage, so
+// the first run waits for the interval instead of slowing down startup.
+func RunIntegrityScrubber(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report := Scrub(time.Now())
+		if len(report.Mismatched) > 0 || len(report.Missing) > 0 || len(report.Errors) > 0 {
+			log.Printf("Integrity scrubber found %d damaged and %d missing contents out of %d, %d errors",
+				len(report.Mismatched), len(report.Missing), report.Checked, len(report.Errors))
+		}
+	}
+}
+
+// Scrub re-hashes every blob and compares it with the SHA-256 it is stored
+// under and the size recorded for it. Files stored before deduplication have
+// no checksum, they are only checked to exist with their recorded size.
+func Scrub(now time.Time) ScrubReport {
+	scrubber.run.Lock()
+	defer scrubber.run.Unlock()
+	return scrub(now)
+}
+
+// StartScrub runs Scrub in the background, its progress shows in the
+// reports. It reports false when a scrub is already running.
+func StartScrub(now time.Time) bool {
+	if !scrubber.run.TryLock() {
+		return false
+	}
+
+	// The report is listed as soon as the call returns
+	scrubber.Lock()
+	scrubber.running = &ScrubReport{StartedAt: now, Running: true, Mismatched: []ScrubIssue{}, Missing: []ScrubIssue{}}
+	scrubber.Unlock()
+
+	go func() {
+		defer scrubber.run.Unlock()
+		scrub(now)
+	}()
+	return true
+}
+
+// scrub is Scrub once no other scrub runs
+func scrub(now time.Time) ScrubReport {
+	report := ScrubReport{StartedAt: now, Running: true, Mismatched: []ScrubIssue{}, Missing: []ScrubIssue{}}
+	scrubber.Lock()
+	scrubber.running = &report
+	scrubber.Unlock()
+
+	ctx := context.Background()
+	st := storage.GetStorage()
+
+	for after := ""; ; {
+		blobs, err := blob.GetBlobsAfter(after, scrubPageSize)
+		if err != nil {
+			progress(ScrubReport{Errors: []string{err.Error()}})
+			break
+		}
+		for _, b := range blobs {
+			var found ScrubReport
+			scrubBlob(ctx, st, b, &found)
+			progress(found)
+		}
+		if len(blobs) < scrubPageSize {
+			break
+		}
+		after = blobs[len(blobs)-1].Hash
+	}
+
+	var found ScrubReport
+	scrubUnhashedFiles(ctx, st, &found)
+	progress(found)
+
+	scrubber.Lock()
+	report.Running = false
+	report.FinishedAt = time.Now()
+	scrubber.running = nil
+	scrubber.reports = append([]ScrubReport{report}, scrubber.reports...)
+	if len(scrubber.reports) > maxScrubReports {
+		scrubber.reports = scrubber.reports[:maxScrubReports]
+	}
+	scrubber.Unlock()
+
+	return report
+}
+
+// progress adds what was found to the report of the run in progress
+func progress(found ScrubReport) {
+	scrubber.Lock()
+	defer scrubber.Unlock()
+
+	r := scrubber.running
+	r.Checked += found.Checked
+	r.Bytes += found.Bytes
+	r.Unverified += found.Unverified
+	r.Mismatched = append(r.Mismatched, found.Mismatched...)
+	r.Missing = append(r.Missing, found.Missing...)
+	r.Errors = append(r.Errors, found.Errors...)
+}
+
+// scrubBlob reads a blob back and records it in the report when it is damaged or gone
+func scrubBlob(ctx context.Context, st storage.Storage, b blob.Blob, report *ScrubReport) {
+	// Content being written or deleted right now is checked on the next run
+	if b.Pending || b.Deleting {
+		return
+	}
+
+	issue := ScrubIssue{Key: blob.BlobKey(b.Hash), Hash: b.Hash, Size: b.Size}
+
+	r, err := st.Get(ctx, issue.Key, 0, -1)
+	if err == storage.ErrNotExist {
+		report.Missing = append(report.Missing, withFiles(issue, report))
+		return
+	}
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return
+	}
+	defer r.Close()
+
+	hasher := sha256.New()
+	issue.Read, err = io.Copy(hasher, r)
+	report.Checked++
+	report.Bytes += issue.Read
+
+	// Encrypted content that fails authentication was changed on disk
+	if err == storage.ErrSealBroken {
+		issue.Error = err.Error()
+		report.Mismatched = append(report.Mismatched, withFiles(issue, report))
+		return
+	}
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return
+	}
+
+	issue.Actual = hex.EncodeToString(hasher.Sum(nil))
+	if issue.Actual != b.Hash || issue.Read != b.Size {
+		report.Mismatched = append(report.Mismatched, withFiles(issue, report))
+	}
+}
+
+// scrubUnhashedFiles checks the files stored before deduplication are still there
+func scrubUnhashedFiles(ctx context.Context, st storage.Storage, report *ScrubReport) {
+	files, err := file.GetUnhashedFiles()
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return
+	}
+
+	for _, f := range files {
+		report.Unverified++
+		issue := ScrubIssue{
+			Key:   utils.DriveKey(f.UUsername, f.Path),
+			Size:  f.Size,
+			Files: []ScrubFile{{Owner: f.UUsername, Path: f.Path}},
+		}
+
+		info, err := st.Stat(ctx, issue.Key)
+		if err == storage.ErrNotExist {
+			report.Missing = append(report.Missing, issue)
+			continue
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		if info.Size != f.Size {
+			issue.Read = info.Size
+			report.Mismatched = append(report.Mismatched, issue)
+		}
+	}
+}
+
+// withFiles adds the drive files holding the content of issue, so the
+// admin knows whose files to restore. Versions and trashed files sharing
+// the content are not listed.
+func withFiles(issue ScrubIssue, report *ScrubReport) ScrubIssue {
+	files, err := file.GetFilesByHash(issue.Hash)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return issue
+	}
+	for _, f := range files {
+		issue.Files = append(issue.Files, ScrubFile{Owner: f.UUsername, Path: f.Path})
+	}
+	return issue
+}
+
+// ScrubReports returns the reports of the latest runs, most recent first,
+// and the run in progress first of all
+func ScrubReports() []ScrubReport {
+	scrubber.Lock()
+	defer scrubber.Unlock()
+
+	reports := make([]ScrubReport, 0, len(scrubber.reports)+1)
+	if r := scrubber.running; r != nil {
+		running := *r
+		running.Mismatched = append([]ScrubIssue{}, r.Mismatched...)
+		running.Missing = append([]ScrubIssue{}, r.Missing...)
+		running.Errors = append([]string(nil), r.Errors...)
+		reports = append(reports, running)
+	}
+	return append(reports, scrubber.reports...)
+}
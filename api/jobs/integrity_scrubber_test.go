@@ -0,0 +1,100 @@
+package jobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poriamsz55/distork/api/models/blob"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/storage"
+)
+
+func TestStartScrub(t *testing.T) {
+	connectTestDB(t)
+	t.Setenv("DISTORK_STORAGE", "local")
+	t.Setenv("DISTORK_LOCAL_ROOT", t.TempDir())
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	local, ok := storage.GetStorage().(*storage.Local)
+	if !ok {
+		t.Skip("the storage is not local")
+	}
+
+	// Store a healthy, a damaged and a missing content, each held by a file
+	hashes := map[string]string{}
+	for _, name := range []string{"healthy", "damaged", "missing"} {
+		content := strings.Repeat(name, 10)
+		sum := sha256.Sum256([]byte(content))
+		hashes[name] = hex.EncodeToString(sum[:])
+
+		if _, err := blob.Store(context.Background(), hashes[name], strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+		f := file.NewFile("alice", "/"+name+".txt", int64(len(content)), time.Now(), false)
+		f.Hash = hashes[name]
+		if err := f.AddFileToDB(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keyPath := func(name string) string {
+		return filepath.Join(local.Root, filepath.FromSlash(blob.BlobKey(hashes[name])))
+	}
+	if err := os.WriteFile(keyPath("damaged"), []byte(strings.Repeat("x", 70)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(keyPath("missing")); err != nil {
+		t.Fatal(err)
+	}
+
+	if !StartScrub(time.Now()) {
+		t.Fatal("StartScrub didn't start a scrub")
+	}
+
+	// The run shows in the reports until it is done
+	var report ScrubReport
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		reports := ScrubReports()
+		if len(reports) == 0 {
+			t.Fatal("no report while scrubbing")
+		}
+		if report = reports[0]; !report.Running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the scrub didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(report.Errors) > 0 {
+		t.Fatal(report.Errors)
+	}
+	if report.Checked != 2 || report.FinishedAt.IsZero() {
+		t.Errorf("Checked = %d, FinishedAt = %v, want 2 contents checked", report.Checked, report.FinishedAt)
+	}
+
+	if len(report.Mismatched) != 1 {
+		t.Fatalf("Mismatched = %+v, want the damaged content", report.Mismatched)
+	}
+	damaged := report.Mismatched[0]
+	if damaged.Hash != hashes["damaged"] || damaged.Actual == damaged.Hash ||
+		len(damaged.Files) != 1 || damaged.Files[0].Path != "/damaged.txt" {
+		t.Errorf("Mismatched = %+v, want the damaged content held by /damaged.txt", damaged)
+	}
+
+	if len(report.Missing) != 1 {
+		t.Fatalf("Missing = %+v, want the missing content", report.Missing)
+	}
+	missing := report.Missing[0]
+	if missing.Hash != hashes["missing"] || len(missing.Files) != 1 || missing.Files[0].Path != "/missing.txt" {
+		t.Errorf("Missing = %+v, want the missing content held by /missing.txt", missing)
+	}
+}
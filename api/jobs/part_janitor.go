@@ -0,0 +1,252 @@
+package jobs
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/upload"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/storage"
+	"github.com/poriamsz55/distork/utils"
+)
+
+// maxJanitorReports is how many reports are kept for the admin
+const maxJanitorReports = 20
+
+// RemovedPart is an abandoned upload part deleted by the janitor
+type RemovedPart struct {
+	Owner   string    `json:"owner,omitempty"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// JanitorReport describes one run of the part janitor
+type JanitorReport struct {
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt time.Time     `json:"finished_at"`
+	Scanned    int           `json:"scanned"`
+	Removed    []RemovedPart `json:"removed"`
+	Reclaimed  int64         `json:"reclaimed"`
+	Errors     []string      `json:"errors,omitempty"`
+}
+
+var janitor struct {
+	sync.Mutex
+	run     sync.Mutex
+	reports []JanitorReport
+}
+
+// RunPartJanitor periodically deletes the parts of chunked uploads that were abandoned
+func RunPartJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		report := CleanStaleParts(time.Now())
+		if len(report.Removed) > 0 || len(report.Errors) > 0 {
+			log.Printf("Part janitor removed %d parts, reclaimed %d bytes, %d errors",
+				len(report.Removed), report.Reclaimed, len(report.Errors))
+		}
+		<-ticker.C
+	}
+}
+
+// CleanStaleParts removes upload parts not modified since PartMaxAge:
+// parts of the legacy chunk upload that never got their last chunk,
+// tus or session data whose upload no longer exists and staged uploads
+// left behind by a crash
+func CleanStaleParts(now time.Time) JanitorReport {
+	janitor.run.Lock()
+	defer janitor.run.Unlock()
+
+	report := JanitorReport{StartedAt: now, Removed: []RemovedPart{}}
+	cutoff := now.Add(-config.GetConfigDrive().PartMaxAge)
+
+	// Legacy parts are named name.part-N-timestamp. They are staged in PartDir,
+	// older versions kept them next to the drive files in the storage.
+	cleanStoredParts(cutoff, &report)
+	cleanStagedParts(cutoff, &report)
+
+	// tus and session data are named after their upload id,
+	// staged uploads belong to no upload and go once they are old
+	drive := config.GetConfigDrive()
+	for _, dir := range []string{drive.TusDir, drive.SessionDir, drive.StagingDir} {
+		cleanOrphanedUploads(dir, cutoff, &report)
+	}
+
+	report.FinishedAt = time.Now()
+
+	janitor.Lock()
+	janitor.reports = append([]JanitorReport{report}, janitor.reports...)
+	if len(janitor.reports) > maxJanitorReports {
+		janitor.reports = janitor.reports[:maxJanitorReports]
+	}
+	janitor.Unlock()
+
+	return report
+}
+
+// cleanStoredParts removes the stale parts kept in the upload directory of the storage
+func cleanStoredParts(cutoff time.Time, report *JanitorReport) {
+	st := storage.GetStorage()
+	uploadDir := storage.Key(config.GetConfigDrive().UploadDir)
+	objects, err := st.List(context.Background(), uploadDir)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return
+	}
+
+	for _, obj := range objects {
+		if !utils.IsChunkPart(obj.Key) {
+			continue
+		}
+		report.Scanned++
+
+		if obj.ModTime.After(cutoff) {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(obj.Key, uploadDir+"/"), "/", 2)
+		if len(parts) < 2 {
+			continue
+		}
+
+		if err := st.Delete(context.Background(), obj.Key); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		file.DeleteEntryFromDB(parts[0], parts[1])
+
+		report.Removed = append(report.Removed, RemovedPart{
+			Owner:   parts[0],
+			Path:    utils.CleanDrivePath(parts[1]),
+			Size:    obj.Size,
+			ModTime: obj.ModTime,
+		})
+		report.Reclaimed += obj.Size
+	}
+}
+
+// cleanStagedParts removes the stale parts staged on local disk
+func cleanStagedParts(cutoff time.Time, report *JanitorReport) {
+	partDir := config.GetConfigDrive().PartDir
+	err := filepath.WalkDir(partDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !utils.IsChunkPart(d.Name()) {
+			return nil
+		}
+		report.Scanned++
+
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(partDir, p)
+		parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+		if len(parts) < 2 {
+			return nil
+		}
+
+		if err := os.Remove(p); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			return nil
+		}
+
+		report.Removed = append(report.Removed, RemovedPart{
+			Owner:   parts[0],
+			Path:    utils.CleanDrivePath(parts[1]),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		report.Reclaimed += info.Size()
+		return nil
+	})
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+}
+
+// cleanOrphanedUploads removes the entries of dir that no upload refers to anymore
+func cleanOrphanedUploads(dir string, cutoff time.Time, report *JanitorReport) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			report.Errors = append(report.Errors, err.Error())
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		report.Scanned++
+
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		exists, err := upload.UploadExists(entry.Name())
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		if exists {
+			continue
+		}
+
+		p := filepath.Join(dir, entry.Name())
+		size := info.Size()
+		if entry.IsDir() {
+			size = dirSize(p)
+		}
+
+		if err := os.RemoveAll(p); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+
+		report.Removed = append(report.Removed, RemovedPart{
+			Path:    filepath.ToSlash(p),
+			Size:    size,
+			ModTime: info.ModTime(),
+		})
+		report.Reclaimed += size
+	}
+}
+
+// dirSize returns the bytes of all the files below p
+func dirSize(p string) int64 {
+	var size int64
+	filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// JanitorReports returns the latest reports, most recent first
+func JanitorReports() []JanitorReport {
+	janitor.Lock()
+	defer janitor.Unlock()
+
+	reports := make([]JanitorReport, len(janitor.reports))
+	copy(reports, janitor.reports)
+	return reports
+}
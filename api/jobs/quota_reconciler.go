@@ -0,0 +1,193 @@
+package jobs
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/trash"
+	"github.com/poriamsz55/distork/api/models/upload"
+	"github.com/poriamsz55/distork/api/models/user"
+	"github.com/poriamsz55/distork/api/models/version"
+)
+
+// maxReconcileReports is how many reports are kept for the admin
+const maxReconcileReports = 20
+
+// DriveUsage is what a user's drive holds, next to what is recorded for it
+type DriveUsage struct {
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	DriveSize int64  `json:"drive_size"`
+	DriveUsed int64  `json:"drive_used"` // as recorded in the users collection
+	Files     int64  `json:"files"`
+	Trash     int64  `json:"trash"`
+	Versions  int64  `json:"versions"`
+	Reserved  int64  `json:"reserved"` // by resumable uploads in progress
+	Actual    int64  `json:"actual"`   // what DriveUsed should be
+}
+
+// QuotaCorrection is a drive usage fixed by the reconciler
+type QuotaCorrection struct {
+	Username string `json:"username"`
+	Recorded int64  `json:"recorded"`
+	Actual   int64  `json:"actual"`
+}
+
+// ReconcileReport describes one run of the quota reconciler
+type ReconcileReport struct {
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Users      int               `json:"users"`
+	Corrected  []QuotaCorrection `json:"corrected"`
+	Skipped    []string          `json:"skipped,omitempty"` // users whose drive changed during the run
+	Errors     []string          `json:"errors,omitempty"`
+}
+
+var reconciler struct {
+	sync.Mutex
+	run     sync.Mutex
+	reports []ReconcileReport
+}
+
+// RunQuotaReconciler periodically corrects the drive usage recorded for every user
+func RunQuotaReconciler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		report := ReconcileQuotas(time.Now())
+		if len(report.Corrected) > 0 || len(report.Errors) > 0 {
+			log.Printf("Quota reconciler corrected %d of %d users, %d errors",
+				len(report.Corrected), report.Users, len(report.Errors))
+		}
+		<-ticker.C
+	}
+}
+
+// MeasureUsage adds up what the drive of username holds: its files, trash
+// and versions at their full size, even when their content is stored once
+// for several of them, and the space reserved by its upload sessions.
+// Every user is measured when username is empty.
+func MeasureUsage(username string) ([]DriveUsage, error) {
+	var users []user.User
+	if username != "" {
+		usr, err := user.GetUserByUsername(username)
+		if err != nil {
+			return nil, err
+		}
+		users = []user.User{usr}
+	} else {
+		var err error
+		users, err = user.GetUsers()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := file.DriveUsage(username)
+	if err != nil {
+		return nil, err
+	}
+	trashed, err := trash.TrashUsage(username)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := version.VersionUsage(username)
+	if err != nil {
+		return nil, err
+	}
+	reserved, err := upload.ReservedUsage(username)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make([]DriveUsage, 0, len(users))
+	for _, u := range users {
+		usage = append(usage, DriveUsage{
+			Username:  u.Username,
+			Role:      u.Role,
+			DriveSize: u.DriveSize,
+			DriveUsed: u.DriveUsed,
+			Files:     files[u.Username],
+			Trash:     trashed[u.Username],
+			Versions:  versions[u.Username],
+			Reserved:  reserved[u.Username],
+			Actual:    files[u.Username] + trashed[u.Username] + versions[u.Username] + reserved[u.Username],
+		})
+	}
+	return usage, nil
+}
+
+// ReconcileQuotas measures every drive and corrects the usage recorded for
+// it. A correction is an $inc applied only while the recorded usage is the
+// one measured, a user whose usage changed meanwhile is left for the next run.
+// So is a user whose drive was changing while it was measured: an upload
+// charged but not indexed yet, or a delete that removed entries but didn't
+// free their bytes yet, would otherwise be corrected away.
+func ReconcileQuotas(now time.Time) ReconcileReport {
+	reconciler.run.Lock()
+	defer reconciler.run.Unlock()
+
+	report := ReconcileReport{StartedAt: now, Corrected: []QuotaCorrection{}}
+
+	before := user.AllDriveChanges()
+	usage, err := MeasureUsage("")
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	report.Users = len(usage)
+
+	for _, u := range usage {
+		if u.Actual == u.DriveUsed {
+			continue
+		}
+		if changing(before[u.Username], user.DriveChanges(u.Username)) {
+			report.Skipped = append(report.Skipped, u.Username)
+			continue
+		}
+
+		ok, err := user.CorrectDriveUsed(u.Username, u.DriveUsed, u.Actual-u.DriveUsed)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		if !ok {
+			report.Skipped = append(report.Skipped, u.Username)
+			continue
+		}
+		report.Corrected = append(report.Corrected, QuotaCorrection{
+			Username: u.Username,
+			Recorded: u.DriveUsed,
+			Actual:   u.Actual,
+		})
+	}
+
+	report.FinishedAt = time.Now()
+
+	reconciler.Lock()
+	reconciler.reports = append([]ReconcileReport{report}, reconciler.reports...)
+	if len(reconciler.reports) > maxReconcileReports {
+		reconciler.reports = reconciler.reports[:maxReconcileReports]
+	}
+	reconciler.Unlock()
+
+	return report
+}
+
+// changing tells whether a drive was changing at some point between the marks
+// taken before and after it was measured
+func changing(before, after user.DriveChangeMark) bool {
+	return before.Active > 0 || after.Active > 0 || before.Started != after.Started
+}
+
+// ReconcileReports returns the reports of the latest runs, most recent first
+func ReconcileReports() []ReconcileReport {
+	reconciler.Lock()
+	defer reconciler.Unlock()
+
+	reports := make([]ReconcileReport, len(reconciler.reports))
+	copy(reports, reconciler.reports)
+	return reports
+}
@@ -0,0 +1,102 @@
+package jobs
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/user"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/database"
+)
+
+// connectTestDB connects to an empty distork_test database on the local
+// MongoDB, e.g. DISTORK_TEST_MONGO=1 go test ./api/jobs/
+func connectTestDB(t *testing.T) {
+	if os.Getenv("DISTORK_TEST_MONGO") == "" {
+		t.Skip("DISTORK_TEST_MONGO is not set")
+	}
+
+	config.GetConfigDB().DatabaseName = "distork_test"
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Drop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Drop(context.Background()) })
+}
+
+func Test_changing(t *testing.T) {
+	tests := []struct {
+		before, after user.DriveChangeMark
+		changing      bool
+	}{
+		{user.DriveChangeMark{}, user.DriveChangeMark{}, false},
+		{user.DriveChangeMark{Started: 3}, user.DriveChangeMark{Started: 3}, false},
+		{user.DriveChangeMark{Active: 1, Started: 3}, user.DriveChangeMark{Started: 3}, true},
+		{user.DriveChangeMark{Started: 3}, user.DriveChangeMark{Active: 1, Started: 4}, true},
+		{user.DriveChangeMark{Started: 3}, user.DriveChangeMark{Started: 4}, true},
+	}
+	for _, tt := range tests {
+		if got := changing(tt.before, tt.after); got != tt.changing {
+			t.Errorf("changing(%+v, %+v) = %v, want %v", tt.before, tt.after, got, tt.changing)
+		}
+	}
+}
+
+func TestReconcileQuotas(t *testing.T) {
+	connectTestDB(t)
+
+	// Every user holds a file of 100 bytes
+	for _, u := range []struct {
+		username string
+		used     int64
+	}{{"drifted", 700}, {"exact", 100}, {"busy", 0}} {
+		usr := &user.User{Username: u.username, Role: "user", DriveSize: 1000, DriveUsed: u.used}
+		if err := usr.AddUserToDB(); err != nil {
+			t.Fatal(err)
+		}
+		if err := file.NewFile(u.username, "/a.txt", 100, time.Now(), false).AddFileToDB(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An upload of busy indexed its file but isn't charged yet
+	done := user.BeginDriveChange("busy")
+	defer done()
+
+	report := ReconcileQuotas(time.Now())
+	if len(report.Errors) > 0 {
+		t.Fatal(report.Errors)
+	}
+	if report.Users != 3 {
+		t.Errorf("Users = %d, want 3", report.Users)
+	}
+	want := QuotaCorrection{Username: "drifted", Recorded: 700, Actual: 100}
+	if len(report.Corrected) != 1 || report.Corrected[0] != want {
+		t.Errorf("Corrected = %+v, want %+v", report.Corrected, want)
+	}
+	if len(report.Skipped) != 1 || report.Skipped[0] != "busy" {
+		t.Errorf("Skipped = %v, want [busy]", report.Skipped)
+	}
+
+	for username, used := range map[string]int64{"drifted": 100, "exact": 100, "busy": 0} {
+		usr, err := user.GetUserByUsername(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usr.DriveUsed != used {
+			t.Errorf("DriveUsed of %s = %d, want %d", username, usr.DriveUsed, used)
+		}
+	}
+
+	// Once the upload is done the drive is reconciled again
+	done()
+	if report := ReconcileQuotas(time.Now()); len(report.Corrected) != 1 || report.Corrected[0].Username != "busy" {
+		t.Errorf("Corrected after the change = %+v, want busy", report.Corrected)
+	}
+}
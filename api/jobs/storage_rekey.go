@@ -0,0 +1,126 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/storage"
+)
+
+// maxRekeyReports is how many reports are kept for the admin
+const maxRekeyReports = 20
+
+// ErrNotEncrypted is returned by StartRekey when no master key is configured
+var ErrNotEncrypted = errors.New("Encryption at rest is not enabled.")
+
+// RekeyReport describes one run of the storage rekeying, the report of a run
+// in progress shows how far it got
+type RekeyReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Running    bool      `json:"running"`
+	KeyId      string    `json:"key_id"`  // of the master key objects are sealed with now
+	Scanned    int       `json:"scanned"` // objects looked at
+	Rekeyed    int       `json:"rekeyed"` // objects sealed again or encrypted for the first time
+	Changed    int       `json:"changed"` // objects changed while they were rekeyed, left for the next run
+	Errors     []string  `json:"errors,omitempty"`
+}
+
+var rekeyer struct {
+	sync.Mutex
+	run     sync.Mutex
+	running *RekeyReport // the run in progress
+	reports []RekeyReport
+}
+
+// StartRekey seals every drive object, in the drive, the trash, the versions
+// and the blobs, with the current master key. Run it after a new master key
+// is put first, the old one can be dropped once a run ends without errors
+// or changed objects. Rewriting the whole storage takes long, it runs in the
+// background and its progress shows in the reports. It reports false when
+// a run is already in progress.
+func StartRekey(now time.Time) (bool, error) {
+	st, ok := storage.GetStorage().(*storage.Encrypted)
+	if !ok {
+		return false, ErrNotEncrypted
+	}
+	if !rekeyer.run.TryLock() {
+		return false, nil
+	}
+
+	report := &RekeyReport{StartedAt: now, Running: true, KeyId: st.CurrentKeyId()}
+	rekeyer.Lock()
+	rekeyer.running = report
+	rekeyer.Unlock()
+
+	go func() {
+		defer rekeyer.run.Unlock()
+		rekey(st, report)
+	}()
+	return true, nil
+}
+
+// rekey is a run of StartRekey, it records its progress in report
+func rekey(st *storage.Encrypted, report *RekeyReport) {
+	ctx := context.Background()
+	progress := func(update func(r *RekeyReport)) {
+		rekeyer.Lock()
+		update(report)
+		rekeyer.Unlock()
+	}
+
+	cfg := config.GetConfigDrive()
+	for _, dir := range []string{cfg.UploadDir, cfg.TrashDir, cfg.VersionDir, cfg.BlobDir, cfg.QuarantineDir} {
+		objects, err := st.List(ctx, storage.Key(dir))
+		if err != nil {
+			progress(func(r *RekeyReport) { r.Errors = append(r.Errors, err.Error()) })
+			continue
+		}
+
+		for _, obj := range objects {
+			rekeyed, err := st.Rekey(ctx, obj.Key)
+			progress(func(r *RekeyReport) {
+				r.Scanned++
+				switch {
+				case err == storage.ErrNotExist:
+					// deleted since it was listed
+				case err == storage.ErrChanged:
+					r.Changed++
+				case err != nil:
+					r.Errors = append(r.Errors, fmt.Sprintf("%s: %s", obj.Key, err))
+				case rekeyed:
+					r.Rekeyed++
+				}
+			})
+		}
+	}
+
+	rekeyer.Lock()
+	report.Running = false
+	report.FinishedAt = time.Now()
+	rekeyer.running = nil
+	rekeyer.reports = append([]RekeyReport{*report}, rekeyer.reports...)
+	if len(rekeyer.reports) > maxRekeyReports {
+		rekeyer.reports = rekeyer.reports[:maxRekeyReports]
+	}
+	rekeyer.Unlock()
+}
+
+// RekeyReports returns the reports of the latest runs, most recent first,
+// and the run in progress first of all
+func RekeyReports() []RekeyReport {
+	rekeyer.Lock()
+	defer rekeyer.Unlock()
+
+	reports := make([]RekeyReport, 0, len(rekeyer.reports)+1)
+	if r := rekeyer.running; r != nil {
+		running := *r
+		running.Errors = append([]string(nil), r.Errors...)
+		reports = append(reports, running)
+	}
+	return append(reports, rekeyer.reports...)
+}
@@ -0,0 +1,33 @@
+package jobs
+
+import (
+	"log"
+	"time"
+
+	"github.com/poriamsz55/distork/api/models/trash"
+)
+
+// RunTrashPurger permanently removes trashed items once their retention period has passed
+func RunTrashPurger(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		PurgeExpiredTrash(time.Now())
+		<-ticker.C
+	}
+}
+
+func PurgeExpiredTrash(now time.Time) {
+	items, err := trash.GetExpiredTrashItems(now)
+	if err != nil {
+		log.Printf("Error listing expired trash: %v", err)
+		return
+	}
+
+	for _, item := range items {
+		if err := item.Purge(); err != nil && err != trash.ErrItemTaken {
+			log.Printf("Error purging trash item %s of %s: %v", item.TrashId, item.UUsername, err)
+		}
+	}
+}
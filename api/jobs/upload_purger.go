@@ -0,0 +1,59 @@
+package jobs
+
+import (
+	"log"
+	"time"
+
+	"github.com/poriamsz55/distork/api/models/upload"
+)
+
+// RunUploadPurger removes unfinished tus uploads and upload sessions that expired
+func RunUploadPurger(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		PurgeExpiredUploads(time.Now())
+		<-ticker.C
+	}
+}
+
+func PurgeExpiredUploads(now time.Time) {
+	uploads, err := upload.GetExpiredTusUploads(now)
+	if err != nil {
+		log.Printf("Error listing expired uploads: %v", err)
+		return
+	}
+
+	// Deleting an upload also releases the space it reserved
+	for _, t := range uploads {
+		if err := purgeTusUpload(t); err != nil {
+			log.Printf("Error deleting expired upload %s of %s: %v", t.UploadId, t.UUsername, err)
+		}
+	}
+
+	// Deleting a session also releases the space it reserved
+	sessions, err := upload.GetExpiredUploadSessions(now)
+	if err != nil {
+		log.Printf("Error listing expired upload sessions: %v", err)
+		return
+	}
+
+	for _, s := range sessions {
+		if err := s.DeleteExpired(now); err != nil {
+			log.Printf("Error deleting expired upload session %s of %s: %v", s.UploadId, s.UUsername, err)
+		}
+	}
+}
+
+// purgeTusUpload deletes an expired tus upload unless a request
+// resumed it while it was waiting for its lock
+func purgeTusUpload(t upload.TusUpload) error {
+	unlock := upload.LockTusUpload(t.UploadId)
+	defer unlock()
+
+	if _, err := upload.GetTusUpload(t.UUsername, t.UploadId); err == nil {
+		return nil
+	}
+	return t.Delete()
+}
@@ -0,0 +1,53 @@
+package middlewares
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/models/apppass"
+	"github.com/poriamsz55/distork/api/models/user"
+	config "github.com/poriamsz55/distork/configs"
+)
+
+// DAVAuthMiddleware signs WebDAV clients in with a JWT or, since most of them
+// only speak basic authentication, with the username and an app password.
+// Unlike the drive routes there is no guest access.
+func DAVAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		usr := davUser(c.Request())
+		if usr == nil || usr.Role == config.RoleGuest {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="Distork", charset="UTF-8"`)
+			return echo.NewHTTPError(http.StatusUnauthorized, "Unauthorized")
+		}
+
+		c.Set("user", usr)
+		return next(c)
+	}
+}
+
+func davUser(r *http.Request) *user.User {
+	if tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if verifyToken(tokenString) != nil {
+			return nil
+		}
+		usr, err := user.GetUserByToken(tokenString)
+		if err != nil {
+			return nil
+		}
+		return usr
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil
+	}
+	if _, err := apppass.CheckAppPassword(username, password); err != nil {
+		return nil
+	}
+	usr, err := user.GetUserByUsername(username)
+	if err != nil {
+		return nil
+	}
+	return &usr
+}
@@ -16,6 +16,16 @@ func JWTMiddleWares(e *echo.Group) {
 	e.Use(OptionalJWTMiddleware)
 }
 
+func AdminMiddleWares(e *echo.Group) {
+	// Only admins past this point
+	e.Use(AdminMiddleware)
+}
+
+func DAVMiddleWares(e *echo.Group) {
+	// JWT or app password, no guests
+	e.Use(DAVAuthMiddleware)
+}
+
 func WSJWTMiddleWares(e *echo.Group) {
 	// JWT
 	e.Use(WSOptionalJWTMiddleware)
@@ -122,6 +132,18 @@ func CheckJWTMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// AdminMiddleware rejects users that are not admins, it must run after a JWT middleware
+func AdminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		usr, ok := c.Get("user").(*user.User)
+		if !ok || usr.Role != config.RoleAdmin {
+			return echo.NewHTTPError(http.StatusForbidden, "Forbidden")
+		}
+
+		return next(c)
+	}
+}
+
 func verifyToken(tokenString string) error {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		return config.GetSharedConfig().JwtSecret, nil
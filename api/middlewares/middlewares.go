@@ -21,10 +21,18 @@ func MiddleWares(e *echo.Group) {
 		AllowOrigins: []string{"http://localhost:3000", "https://localhost:3000",
 			"http://127.0.0.1:3000", "https://127.0.0.1:3000",
 			"http://drive.madarasoli.info", "https://drive.madarasoli.info"}, // Adjust this to match your client's origin
-		AllowMethods: []string{echo.GET, echo.PUT, echo.POST,
-			echo.DELETE, echo.OPTIONS},
+		AllowMethods: []string{echo.GET, echo.HEAD, echo.PUT, echo.POST,
+			echo.PATCH, echo.DELETE, echo.OPTIONS},
 		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType,
-			echo.HeaderAccept, echo.HeaderAuthorization},
+			echo.HeaderAccept, echo.HeaderAuthorization,
+			"Range", "If-Range", echo.HeaderIfModifiedSince, "If-None-Match",
+			"Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset", "Upload-Defer-Length",
+			"X-Chunk-Sha256", "X-Share-Password"},
+		// Let the client read the headers needed to resume and cache downloads and uploads
+		ExposeHeaders: []string{echo.HeaderContentDisposition, echo.HeaderContentLength,
+			"Content-Range", "Accept-Ranges", "ETag", echo.HeaderLastModified, echo.HeaderLocation,
+			"Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size",
+			"Upload-Length", "Upload-Offset", "Upload-Expires"},
 		AllowCredentials: true, // Enable credentials support
 	}))
 
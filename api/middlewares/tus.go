@@ -0,0 +1,26 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+const TusVersion = "1.0.0"
+
+// TusMiddleware adds the Tus-Resumable header to every response and rejects
+// requests made with a version of the tus protocol the server doesn't speak
+func TusMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set("Tus-Resumable", TusVersion)
+		c.Response().Header().Set("Tus-Version", TusVersion)
+
+		// The discovery request is the only one allowed without the header
+		if c.Request().Method != http.MethodOptions &&
+			c.Request().Header.Get("Tus-Resumable") != TusVersion {
+			return c.NoContent(http.StatusPreconditionFailed)
+		}
+
+		return next(c)
+	}
+}
@@ -0,0 +1,111 @@
+package apppass
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/database"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AppPassword lets a client that can't sign in, like a WebDAV mount, act for
+// a user. Only a hash of the password is kept, it is shown once when created.
+type AppPassword struct {
+	PasswordId string     `json:"password_id" bson:"password_id"`
+	UUsername  string     `json:"u_username" bson:"u_username"`
+	Name       string     `json:"name" bson:"name"` // what the user calls it, e.g. "laptop rclone"
+	Hash       string     `json:"-" bson:"hash"`    // hex SHA-256 of the password
+	CreatedAt  time.Time  `json:"created_at" bson:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+}
+
+// NewAppPassword returns a new app password of the user and its clear text
+func NewAppPassword(username, name string) (*AppPassword, string, error) {
+	secret, err := utils.GenerateToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &AppPassword{
+		PasswordId: utils.GenerateUUID(),
+		UUsername:  username,
+		Name:       name,
+		Hash:       hashSecret(secret),
+		CreatedAt:  time.Now(),
+	}, secret, nil
+}
+
+// The passwords are random tokens, a fast hash is enough to keep them
+// unusable when the database leaks and lets them be looked up directly
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func collection() *mongo.Collection {
+	return database.Collection(config.GetConfigDB().AppPasswordColl)
+}
+
+// CreateIndexes makes checking a password a single index lookup
+func CreateIndexes() error {
+	_, err := collection().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "u_username", Value: 1}, {Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func (p *AppPassword) AddAppPasswordToDB() error {
+	_, err := collection().InsertOne(context.Background(), p)
+	return err
+}
+
+// GetAppPasswords returns the app passwords of the user, newest first
+func GetAppPasswords(username string) ([]AppPassword, error) {
+	passwords := []AppPassword{}
+	cursor, err := collection().Find(context.Background(),
+		bson.M{"u_username": username},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.Background(), &passwords)
+	if err != nil {
+		return nil, err
+	}
+	return passwords, nil
+}
+
+// CheckAppPassword returns the app password of the user matching secret and
+// records its use, it returns mongo.ErrNoDocuments when none matches
+func CheckAppPassword(username, secret string) (*AppPassword, error) {
+	var p AppPassword
+	err := collection().FindOneAndUpdate(context.Background(),
+		bson.M{"u_username": username, "hash": hashSecret(secret)},
+		bson.M{"$set": bson.M{"last_used_at": time.Now()}}).Decode(&p)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// DeleteAppPassword revokes an app password of the user, it returns
+// mongo.ErrNoDocuments when the user has no such password
+func DeleteAppPassword(username, passwordId string) error {
+	res, err := collection().DeleteOne(context.Background(),
+		bson.M{"u_username": username, "password_id": passwordId})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"path"
+	"time"
+
+	"github.com/poriamsz55/distork/api/models/thumb"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/database"
+	"github.com/poriamsz55/distork/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// releaseTimeout is how long a release may take to delete a content before
+// the uploads waiting for it assume it stopped halfway and take over
+const releaseTimeout = time.Minute
+
+// releasePoll is how often an upload checks whether a release is done
+const releasePoll = 50 * time.Millisecond
+
+// Blob is the content of drive files, stored once for every file, version
+// and trashed file with the same SHA-256. Refs counts those references.
+//
+// Pending is set until the content is written, Deleting while the last
+// release removes it from the storage. An upload referring to a blob being
+// deleted waits for the release to finish before writing the content again.
+type Blob struct {
+	Hash       string    `json:"hash" bson:"hash"`
+	Size       int64     `json:"size" bson:"size"`
+	Refs       int64     `json:"refs" bson:"refs"`
+	CreatedAt  time.Time `json:"created_at" bson:"created_at"`
+	Pending    bool      `json:"pending,omitempty" bson:"pending,omitempty"`
+	Deleting   bool      `json:"deleting,omitempty" bson:"deleting,omitempty"`
+	DeletingAt time.Time `json:"-" bson:"deleting_at,omitempty"`
+}
+
+func collection() *mongo.Collection {
+	return database.Collection(config.GetConfigDB().BlobColl)
+}
+
+// CreateIndexes makes sure every hash is stored once
+func CreateIndexes() error {
+	_, err := collection().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// BlobKey returns the storage key of the content with the given hex SHA-256.
+// Two levels of prefixes keep folders small on the local driver.
+func BlobKey(hash string) string {
+	return path.Join(config.GetConfigDrive().BlobDir, hash[:2], hash[2:4], hash)
+}
+
+// GetBlobsAfter returns up to limit blobs whose hash comes after the given
+// one, in hash order, so every blob can be visited a page at a time
+func GetBlobsAfter(hash string, limit int64) ([]Blob, error) {
+	blobs := []Blob{}
+	cursor, err := collection().Find(context.Background(),
+		bson.M{"hash": bson.M{"$gt": hash}},
+		options.Find().SetSort(bson.D{{Key: "hash", Value: 1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.Background(), &blobs)
+	if err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// Store adds a reference to the blob of hash. The content is read from r
+// and stored only when no blob with that hash exists yet.
+// It reports whether the content was already stored.
+func Store(ctx context.Context, hash string, r io.Reader, size int64) (bool, error) {
+	// The reference is taken first: from then on no release can delete the content
+	var b Blob
+	err := collection().FindOneAndUpdate(ctx,
+		bson.M{"hash": hash},
+		bson.M{
+			"$inc":         bson.M{"refs": 1},
+			"$setOnInsert": bson.M{"size": size, "created_at": time.Now(), "pending": true},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&b)
+	if err != nil {
+		return false, err
+	}
+	if !b.Pending && !b.Deleting {
+		return true, nil
+	}
+
+	// A release that started before the reference was taken may still be
+	// deleting the content, writing it now could be undone
+	if b.Deleting {
+		if err := waitRelease(ctx, hash); err != nil {
+			Release(hash)
+			return false, err
+		}
+	}
+
+	// Storing the same content twice is harmless, so concurrent
+	// uploads of a new hash both write it
+	if _, err := storage.GetStorage().Put(ctx, BlobKey(hash), r, size); err != nil {
+		Release(hash)
+		return false, err
+	}
+
+	_, err = collection().UpdateOne(ctx,
+		bson.M{"hash": hash},
+		bson.M{"$unset": bson.M{"pending": ""}})
+	return false, err
+}
+
+// waitRelease waits until the release deleting the content of hash is
+// done, or takes over when it seems to have stopped
+func waitRelease(ctx context.Context, hash string) error {
+	for {
+		var b Blob
+		if err := collection().FindOne(ctx, bson.M{"hash": hash}).Decode(&b); err != nil {
+			return err
+		}
+		if !b.Deleting {
+			return nil
+		}
+
+		if time.Since(b.DeletingAt) > releaseTimeout {
+			_, err := collection().UpdateOne(ctx,
+				bson.M{"hash": hash, "deleting": true, "deleting_at": b.DeletingAt},
+				bson.M{"$unset": bson.M{"deleting": "", "deleting_at": ""}})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(releasePoll):
+		}
+	}
+}
+
+// AddRef adds a reference to a stored blob, it returns
+// mongo.ErrNoDocuments when no blob with that hash exists
+func AddRef(hash string) error {
+	return collection().FindOneAndUpdate(context.Background(),
+		bson.M{"hash": hash, "refs": bson.M{"$gt": 0}, "deleting": bson.M{"$ne": true}},
+		bson.M{"$inc": bson.M{"refs": 1}}).Err()
+}
+
+// Release drops a reference to the blob of hash and
+// removes its content once nothing refers to it anymore
+func Release(hash string) error {
+	var b Blob
+	err := collection().FindOneAndUpdate(context.Background(),
+		bson.M{"hash": hash},
+		bson.M{"$inc": bson.M{"refs": -1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&b)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil || b.Refs > 0 {
+		return err
+	}
+
+	// Only the release that marks the blob deletes the content. Uploads
+	// taking a reference meanwhile see the mark and wait for it to go.
+	res, err := collection().UpdateOne(context.Background(),
+		bson.M{"hash": hash, "refs": bson.M{"$lte": 0}, "deleting": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"deleting": true, "deleting_at": time.Now(), "pending": true}})
+	if err != nil || res.ModifiedCount == 0 {
+		return err
+	}
+	if err := storage.GetStorage().Delete(context.Background(), BlobKey(hash)); err != nil {
+		clearDeleting(hash)
+		return err
+	}
+
+	// The entry goes unless an upload referred to the content again,
+	// that one stores it once the mark is cleared
+	del, err := collection().DeleteOne(context.Background(),
+		bson.M{"hash": hash, "refs": bson.M{"$lte": 0}})
+	if err != nil {
+		clearDeleting(hash)
+		return err
+	}
+	if del.DeletedCount == 0 {
+		return clearDeleting(hash)
+	}
+	return thumb.DeleteThumbs(hash)
+}
+
+// clearDeleting lets the uploads waiting for a release of hash go on
+func clearDeleting(hash string) error {
+	_, err := collection().UpdateOne(context.Background(),
+		bson.M{"hash": hash},
+		bson.M{"$unset": bson.M{"deleting": "", "deleting_at": ""}})
+	return err
+}
@@ -1,6 +1,21 @@
 package file
 
-import "time"
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/poriamsz55/distork/api/models/blob"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/database"
+	"github.com/poriamsz55/distork/storage"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
 
 // FileInfo struct to hold file name and modification time
 type File struct {
@@ -8,6 +23,303 @@ type File struct {
 	Size      int64     `json:"size" bson:"size"`
 	UUsername string    `json:"u_username" bson:"u_username"`
 	ModTime   time.Time `json:"mod_time" bson:"mod_time"`
-	Path      string    `json:"path" bson:"path"`
+	Path      string    `json:"path" bson:"path"` // path relative to the user's root, e.g. /docs/a.txt
+	Dir       string    `json:"dir" bson:"dir"`   // parent folder of Path, e.g. /docs
 	IsDir     bool      `json:"is_dir" bson:"is_dir"`
+	Hash      string    `json:"hash,omitempty" bson:"hash,omitempty"` // SHA-256 of the content, empty for files stored before deduplication
+	MimeType  string    `json:"mime_type,omitempty" bson:"mime_type,omitempty"`
+
+	// URLs of the thumbnails of an image by size in pixels, filled in listings
+	Thumbnails map[string]string `json:"thumbnails,omitempty" bson:"-"`
+}
+
+func NewFile(username, p string, size int64, modTime time.Time, isDir bool) *File {
+	p = utils.CleanDrivePath(p)
+	return &File{
+		Filename:  path.Base(p),
+		Size:      size,
+		UUsername: username,
+		ModTime:   modTime,
+		Path:      p,
+		Dir:       path.Dir(p),
+		IsDir:     isDir,
+	}
+}
+
+// ContentKey returns the storage key the content of the file is kept under
+func (f *File) ContentKey() string {
+	if f.Hash != "" {
+		return blob.BlobKey(f.Hash)
+	}
+	return utils.DriveKey(f.UUsername, f.Path)
+}
+
+// ContentType returns the media type of the file, files indexed
+// without one get the type of their extension
+func (f *File) ContentType() string {
+	if f.MimeType != "" {
+		return f.MimeType
+	}
+	return utils.DetectMimeType(f.Filename, nil)
+}
+
+func collection() *mongo.Collection {
+	return database.Collection(config.GetConfigDB().FileColl)
+}
+
+// CreateIndexes makes sure a path is unique per user and folder listings and searches are fast
+func CreateIndexes() error {
+	_, err := collection().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "u_username", Value: 1}, {Key: "path", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "u_username", Value: 1}, {Key: "dir", Value: 1}},
+		},
+		// Searches filter and sort the whole drive of a user on these
+		{
+			Keys: bson.D{{Key: "u_username", Value: 1}, {Key: "filename", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "u_username", Value: 1}, {Key: "size", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "u_username", Value: 1}, {Key: "mod_time", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "u_username", Value: 1}, {Key: "mime_type", Value: 1}},
+		},
+	})
+	return err
+}
+
+// AddFileToDB inserts the file or replaces the entry already stored for its path
+func (f *File) AddFileToDB() error {
+	_, err := collection().ReplaceOne(context.Background(),
+		bson.M{"u_username": f.UUsername, "path": f.Path},
+		f,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// EnsureDirs adds a folder entry for dir and every one of its parents
+func EnsureDirs(username, dir string) error {
+	dir = utils.CleanDrivePath(dir)
+	for dir != "/" {
+		_, err := collection().UpdateOne(context.Background(),
+			bson.M{"u_username": username, "path": dir},
+			bson.M{"$setOnInsert": NewFile(username, dir, 0, time.Now(), true)},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+		dir = path.Dir(dir)
+	}
+	return nil
+}
+
+func GetFile(username, p string) (*File, error) {
+	var f File
+	err := collection().FindOne(context.Background(),
+		bson.M{"u_username": username, "path": utils.CleanDrivePath(p)}).Decode(&f)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// GetFilesByDir returns the direct children of dir, most recent first.
+// Parts of unfinished chunked uploads are never listed.
+func GetFilesByDir(username, dir string) ([]File, error) {
+	files := []File{}
+	cursor, err := collection().Find(context.Background(),
+		bson.M{
+			"u_username": username,
+			"dir":        utils.CleanDrivePath(dir),
+			"filename":   bson.M{"$not": primitive.Regex{Pattern: utils.ChunkPartPattern}},
+		},
+		options.Find().SetSort(bson.D{{Key: "mod_time", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.Background(), &files)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// GetFilesByHash returns the files of every drive whose content is the blob of hash
+func GetFilesByHash(hash string) ([]File, error) {
+	files := []File{}
+	cursor, err := collection().Find(context.Background(), bson.M{"hash": hash})
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.Background(), &files)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// GetUnhashedFiles returns the files stored before deduplication, their
+// content is kept under their path and no checksum was recorded for them
+func GetUnhashedFiles() ([]File, error) {
+	files := []File{}
+	cursor, err := collection().Find(context.Background(),
+		bson.M{"is_dir": false, "hash": bson.M{"$exists": false}},
+		options.Find().SetSort(bson.D{{Key: "u_username", Value: 1}, {Key: "path", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.Background(), &files)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// GetOwners returns the usernames that have at least one entry in the index
+func GetOwners() ([]string, error) {
+	values, err := collection().Distinct(context.Background(), "u_username", bson.D{})
+	if err != nil {
+		return nil, err
+	}
+
+	owners := []string{}
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			owners = append(owners, s)
+		}
+	}
+	return owners, nil
+}
+
+// GetTree returns the entry for p and all of its descendants
+func GetTree(username, p string) ([]File, error) {
+	files := []File{}
+	cursor, err := collection().Find(context.Background(), database.TreeFilter(username, p),
+		options.Find().SetSort(bson.D{{Key: "path", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.Background(), &files)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// TreeSize returns the number of bytes used by the files in a tree
+func TreeSize(files []File) int64 {
+	var size int64
+	for _, f := range files {
+		if !f.IsDir {
+			size += f.Size
+		}
+	}
+	return size
+}
+
+// MoveTree changes the path of oldPath and all of its descendants to newPath
+func MoveTree(username, oldPath, newPath string) error {
+	oldPath = utils.CleanDrivePath(oldPath)
+	newPath = utils.CleanDrivePath(newPath)
+
+	files, err := GetTree(username, oldPath)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		moved := NewFile(username, newPath+strings.TrimPrefix(f.Path, oldPath), f.Size, f.ModTime, f.IsDir)
+		_, err := collection().UpdateOne(context.Background(),
+			bson.M{"u_username": username, "path": f.Path},
+			bson.M{"$set": bson.M{
+				"filename": moved.Filename,
+				"path":     moved.Path,
+				"dir":      moved.Dir,
+			}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteFileFromDB removes the entry for p and everything stored below it
+func DeleteFileFromDB(username, p string) error {
+	_, err := collection().DeleteMany(context.Background(), database.TreeFilter(username, p))
+	return err
+}
+
+// DeleteEntryFromDB removes only the entry stored for p
+func DeleteEntryFromDB(username, p string) error {
+	_, err := collection().DeleteOne(context.Background(),
+		bson.M{"u_username": username, "path": utils.CleanDrivePath(p)})
+	return err
+}
+
+// RenameOwner moves every entry of oldUsername to newUsername
+func RenameOwner(oldUsername, newUsername string) error {
+	_, err := collection().UpdateMany(context.Background(),
+		bson.M{"u_username": oldUsername},
+		bson.M{"$set": bson.M{"u_username": newUsername}})
+	return err
+}
+
+// IndexUploads lists the upload directory in the storage and records every
+// file found there with its folders. It is used to build the index for drives
+// created before it existed.
+func IndexUploads() error {
+	uploadDir := config.GetConfigDrive().UploadDir
+	objects, err := storage.GetStorage().List(context.Background(), uploadDir)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objects {
+		// first element is the owner, the rest is the path inside the drive
+		rel := strings.TrimPrefix(obj.Key, storage.Key(uploadDir)+"/")
+		parts := strings.SplitN(rel, "/", 2)
+		if len(parts) < 2 {
+			continue
+		}
+
+		// parts of unfinished chunked uploads are not drive files
+		if utils.IsChunkPart(parts[1]) {
+			continue
+		}
+
+		if err := EnsureDirs(parts[0], path.Dir(utils.CleanDrivePath(parts[1]))); err != nil {
+			return err
+		}
+		// entries already indexed may point at a blob, don't replace them
+		f := NewFile(parts[0], parts[1], obj.Size, obj.ModTime, false)
+		f.MimeType = utils.DetectMimeType(f.Filename, nil)
+		_, err := collection().UpdateOne(context.Background(),
+			bson.M{"u_username": f.UUsername, "path": f.Path},
+			bson.M{"$setOnInsert": f},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DriveUsage returns the bytes of the files in the drive of username,
+// or of every user by username when it is empty
+func DriveUsage(username string) (map[string]int64, error) {
+	filter := bson.M{"is_dir": false}
+	if username != "" {
+		filter["u_username"] = username
+	}
+	return database.SumByUser(collection(), filter, "size")
 }
@@ -0,0 +1,172 @@
+package file
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrInvalidCursor is returned for a cursor that was not made by the same listing
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListSorts maps the sort names of a folder listing to the expressions they
+// sort on. Files indexed without a media type sort as an empty type.
+var ListSorts = map[string]interface{}{
+	"name":  "$filename",
+	"size":  "$size",
+	"type":  bson.M{"$ifNull": bson.A{"$mime_type", ""}},
+	"mtime": "$mod_time",
+}
+
+// Listing is the order and page of a folder listing
+type Listing struct {
+	Sort         string // key of ListSorts
+	Desc         bool
+	FoldersFirst bool
+	Cursor       string // NextCursor of the previous page, empty for the first page
+	Limit        int64
+}
+
+// ListPage is one page of a folder listing
+type ListPage struct {
+	Files      []File
+	Total      int64 // entries in the folder
+	Folders    int64 // folders among them
+	NextCursor string
+}
+
+// listCursor is the position after the last entry of a page. It holds the
+// order it was made for, so it can't be replayed against another one.
+type listCursor struct {
+	Sort         string             `bson:"s"`
+	Desc         bool               `bson:"o"`
+	FoldersFirst bool               `bson:"f"`
+	Dir          int                `bson:"d"`
+	Key          bson.RawValue      `bson:"k"`
+	Id           primitive.ObjectID `bson:"i"`
+}
+
+// listEntry is a File with the sort keys computed by the listing
+type listEntry struct {
+	File `bson:",inline"`
+	Id   primitive.ObjectID `bson:"_id"`
+	Dir  int                `bson:"_dir"`
+	Key  bson.RawValue      `bson:"_key"`
+}
+
+// ListDir returns one page of the direct children of dir. Pages are cut by
+// position rather than offset, so entries added or removed between two
+// requests never shift the following pages. Names sort naturally: a2 before a10.
+func ListDir(username, dir string, l *Listing) (*ListPage, error) {
+	filter := bson.M{
+		"u_username": username,
+		"dir":        utils.CleanDrivePath(dir),
+		"filename":   bson.M{"$not": primitive.Regex{Pattern: utils.ChunkPartPattern}},
+	}
+
+	key, ok := ListSorts[l.Sort]
+	if !ok {
+		return nil, errors.New("invalid sort")
+	}
+	order, op := 1, "$gt"
+	if l.Desc {
+		order, op = -1, "$lt"
+	}
+
+	var dirKey interface{} = 0
+	if l.FoldersFirst {
+		dirKey = bson.M{"$cond": bson.A{"$is_dir", 0, 1}}
+	}
+
+	pipeline := bson.A{
+		bson.M{"$match": filter},
+		bson.M{"$addFields": bson.M{"_dir": dirKey, "_key": key}},
+	}
+
+	if l.Cursor != "" {
+		cur, err := decodeListCursor(l.Cursor)
+		if err != nil || cur.Sort != l.Sort || cur.Desc != l.Desc || cur.FoldersFirst != l.FoldersFirst {
+			return nil, ErrInvalidCursor
+		}
+
+		// Everything after (dir, key, id) in the order of the listing. The id
+		// breaks ties, names like a1 and a01 are equal in natural order.
+		pipeline = append(pipeline, bson.M{"$match": bson.M{"$or": bson.A{
+			bson.M{"_dir": bson.M{"$gt": cur.Dir}},
+			bson.M{"_dir": cur.Dir, "_key": bson.M{op: cur.Key}},
+			bson.M{"_dir": cur.Dir, "_key": cur.Key, "_id": bson.M{op: cur.Id}},
+		}}})
+	}
+
+	// One more entry than the page tells whether there is a next page
+	pipeline = append(pipeline,
+		bson.M{"$sort": bson.D{{Key: "_dir", Value: 1}, {Key: "_key", Value: order}, {Key: "_id", Value: order}}},
+		bson.M{"$limit": l.Limit + 1},
+	)
+
+	opts := options.Aggregate().SetCollation(&options.Collation{Locale: "en", NumericOrdering: true})
+	cursor, err := collection().Aggregate(context.Background(), pipeline, opts)
+	if err != nil {
+		return nil, err
+	}
+	entries := []listEntry{}
+	if err := cursor.All(context.Background(), &entries); err != nil {
+		return nil, err
+	}
+
+	page := &ListPage{Files: []File{}}
+	for i, e := range entries {
+		if int64(i) == l.Limit {
+			last := entries[i-1]
+			page.NextCursor, err = encodeListCursor(&listCursor{
+				Sort:         l.Sort,
+				Desc:         l.Desc,
+				FoldersFirst: l.FoldersFirst,
+				Dir:          last.Dir,
+				Key:          last.Key,
+				Id:           last.Id,
+			})
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		page.Files = append(page.Files, e.File)
+	}
+
+	page.Total, err = collection().CountDocuments(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	filter["is_dir"] = true
+	page.Folders, err = collection().CountDocuments(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func encodeListCursor(cur *listCursor) (string, error) {
+	data, err := bson.Marshal(cur)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeListCursor(s string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cur listCursor
+	if err := bson.Unmarshal(data, &cur); err != nil {
+		return nil, err
+	}
+	return &cur, nil
+}
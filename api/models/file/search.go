@@ -0,0 +1,135 @@
+package file
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SearchSorts maps the sort names of a search to the fields they sort on
+var SearchSorts = map[string]string{
+	"name":  "filename",
+	"size":  "size",
+	"mtime": "mod_time",
+}
+
+// Search holds the filters of a search over the whole drive of a user,
+// zero values don't filter. Folders are only found by name, any file
+// filter leaves them out.
+type Search struct {
+	Name     string   // substring or glob, see utils.NamePattern
+	Exts     []string // extensions without the dot, e.g. jpg
+	MimeType string   // a media type like image/png, or a prefix like image/
+	MinSize  *int64
+	MaxSize  *int64
+	After    time.Time // modified at or after
+	Before   time.Time // modified before
+
+	Sort   string // key of SearchSorts
+	Desc   bool
+	Offset int64
+	Limit  int64
+}
+
+// filter builds the query of the search in the drive of username
+func (s *Search) filter(username string) (bson.M, error) {
+	names := bson.A{bson.M{"filename": bson.M{"$not": primitive.Regex{Pattern: utils.ChunkPartPattern}}}}
+	if s.Name != "" {
+		pattern, err := utils.NamePattern(s.Name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, bson.M{"filename": primitive.Regex{Pattern: pattern, Options: "i"}})
+	}
+
+	if len(s.Exts) > 0 {
+		exts := make([]string, 0, len(s.Exts))
+		for _, ext := range s.Exts {
+			exts = append(exts, regexp.QuoteMeta(strings.TrimPrefix(ext, ".")))
+		}
+		names = append(names, bson.M{"filename": primitive.Regex{Pattern: `\.(` + strings.Join(exts, "|") + `)$`, Options: "i"}})
+	}
+
+	filter := bson.M{"u_username": username, "$and": names}
+
+	if s.MimeType != "" {
+		mimeType := strings.ToLower(s.MimeType)
+		pattern := "^" + regexp.QuoteMeta(mimeType)
+		if !strings.HasSuffix(mimeType, "/") {
+			pattern += `(;|$)`
+		}
+		filter["mime_type"] = primitive.Regex{Pattern: pattern}
+	}
+
+	size := bson.M{}
+	if s.MinSize != nil {
+		size["$gte"] = *s.MinSize
+	}
+	if s.MaxSize != nil {
+		size["$lte"] = *s.MaxSize
+	}
+	if len(size) > 0 {
+		filter["size"] = size
+	}
+
+	modTime := bson.M{}
+	if !s.After.IsZero() {
+		modTime["$gte"] = s.After
+	}
+	if !s.Before.IsZero() {
+		modTime["$lt"] = s.Before
+	}
+	if len(modTime) > 0 {
+		filter["mod_time"] = modTime
+	}
+
+	if len(s.Exts) > 0 || s.MimeType != "" || len(size) > 0 {
+		filter["is_dir"] = false
+	}
+	return filter, nil
+}
+
+// SearchFiles returns one page of the entries of username's drive matching s
+// and how many entries match in total
+func SearchFiles(username string, s *Search) ([]File, int64, error) {
+	filter, err := s.filter(username)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total, err := collection().CountDocuments(context.Background(), filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	field, ok := SearchSorts[s.Sort]
+	if !ok {
+		field = "filename"
+	}
+	order := 1
+	if s.Desc {
+		order = -1
+	}
+
+	// The path breaks ties, so pages don't overlap
+	opts := options.Find().
+		SetSort(bson.D{{Key: field, Value: order}, {Key: "path", Value: 1}}).
+		SetSkip(s.Offset).
+		SetLimit(s.Limit)
+
+	files := []File{}
+	cursor, err := collection().Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := cursor.All(context.Background(), &files); err != nil {
+		return nil, 0, err
+	}
+	return files, total, nil
+}
@@ -0,0 +1,186 @@
+package grant
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/database"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	RoleViewer = "viewer" // can list and download
+	RoleEditor = "editor" // can also upload, rename, move and delete
+)
+
+// Grant gives another user access to a file or folder of a drive and everything below it
+type Grant struct {
+	GrantId   string    `json:"grant_id" bson:"grant_id"`
+	UUsername string    `json:"u_username" bson:"u_username"` // owner of the drive
+	Path      string    `json:"path" bson:"path"`
+	IsDir     bool      `json:"is_dir" bson:"is_dir"`
+	Grantee   string    `json:"grantee" bson:"grantee"`
+	Role      string    `json:"role" bson:"role"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+func NewGrant(owner, p string, isDir bool, grantee, role string) *Grant {
+	return &Grant{
+		GrantId:   utils.GenerateUUID(),
+		UUsername: owner,
+		Path:      utils.CleanDrivePath(p),
+		IsDir:     isDir,
+		Grantee:   grantee,
+		Role:      role,
+		CreatedAt: time.Now(),
+	}
+}
+
+// ValidRole reports whether role can be granted
+func ValidRole(role string) bool {
+	return role == RoleViewer || role == RoleEditor
+}
+
+// Allows reports whether the grant gives at least role
+func (g *Grant) Allows(role string) bool {
+	return g.Role == RoleEditor || role == RoleViewer
+}
+
+func collection() *mongo.Collection {
+	return database.Collection(config.GetConfigDB().GrantColl)
+}
+
+// CreateIndexes makes sure a user gets one grant per path and lookups are fast
+func CreateIndexes() error {
+	_, err := collection().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: "u_username", Value: 1},
+				{Key: "path", Value: 1},
+				{Key: "grantee", Value: 1},
+			},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "grantee", Value: 1}},
+		},
+	})
+	return err
+}
+
+// AddGrantToDB inserts the grant or changes the role of the grant the
+// grantee already has on the same path. The stored grant is decoded into g.
+func (g *Grant) AddGrantToDB() error {
+	return collection().FindOneAndUpdate(context.Background(),
+		bson.M{"u_username": g.UUsername, "path": g.Path, "grantee": g.Grantee},
+		bson.M{
+			"$set": bson.M{"role": g.Role, "is_dir": g.IsDir},
+			"$setOnInsert": bson.M{
+				"grant_id":   g.GrantId,
+				"created_at": g.CreatedAt,
+			},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(g)
+}
+
+// DeleteGrant revokes a grant of the owner, it returns mongo.ErrNoDocuments when there is none
+func DeleteGrant(owner, grantId string) error {
+	res, err := collection().DeleteOne(context.Background(),
+		bson.M{"u_username": owner, "grant_id": grantId})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// GetGrants returns the grants the owner gave on p and below it
+func GetGrants(owner, p string) ([]Grant, error) {
+	return findGrants(database.TreeFilter(owner, p))
+}
+
+// GetGrantsTo returns the grants given to grantee by every owner
+func GetGrantsTo(grantee string) ([]Grant, error) {
+	return findGrants(bson.M{"grantee": grantee})
+}
+
+// FindGrant returns the strongest grant given to grantee on p or on one of its parents
+func FindGrant(owner, grantee, p string) (*Grant, error) {
+	p = utils.CleanDrivePath(p)
+
+	// p and each of its parents, the root can't be granted
+	paths := []string{}
+	for ; p != "/"; p = path.Dir(p) {
+		paths = append(paths, p)
+	}
+
+	grants, err := findGrants(bson.M{
+		"u_username": owner,
+		"grantee":    grantee,
+		"path":       bson.M{"$in": paths},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(grants) == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	best := grants[0]
+	for _, g := range grants[1:] {
+		if g.Role == RoleEditor {
+			best = g
+		}
+	}
+	return &best, nil
+}
+
+// MoveGrants updates the grants on oldPath and below it to newPath
+func MoveGrants(owner, oldPath, newPath string) error {
+	oldPath = utils.CleanDrivePath(oldPath)
+	newPath = utils.CleanDrivePath(newPath)
+
+	grants, err := GetGrants(owner, oldPath)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range grants {
+		_, err := collection().UpdateOne(context.Background(),
+			bson.M{"u_username": owner, "grant_id": g.GrantId},
+			bson.M{"$set": bson.M{"path": newPath + strings.TrimPrefix(g.Path, oldPath)}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteGrants removes the grants on p and below it
+func DeleteGrants(owner, p string) error {
+	_, err := collection().DeleteMany(context.Background(), database.TreeFilter(owner, p))
+	return err
+}
+
+func findGrants(filter bson.M) ([]Grant, error) {
+	grants := []Grant{}
+	cursor, err := collection().Find(context.Background(), filter,
+		options.Find().SetSort(bson.D{{Key: "u_username", Value: 1}, {Key: "path", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.Background(), &grants)
+	if err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
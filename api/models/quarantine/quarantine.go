@@ -0,0 +1,102 @@
+package quarantine
+
+import (
+	"context"
+	"path"
+	"time"
+
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/database"
+	"github.com/poriamsz55/distork/storage"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Item is an upload the scanner found malware in. Its content is kept outside
+// of every drive and is not charged to the owner until an admin releases it.
+type Item struct {
+	QuarantineId string    `json:"quarantine_id" bson:"quarantine_id"`
+	UUsername    string    `json:"u_username" bson:"u_username"`
+	Path         string    `json:"path" bson:"path"` // where the upload was going, e.g. /docs/setup.exe
+	Size         int64     `json:"size" bson:"size"`
+	Hash         string    `json:"hash" bson:"hash"` // SHA-256 of the content
+	Signature    string    `json:"signature" bson:"signature"`
+	CreatedAt    time.Time `json:"created_at" bson:"created_at"`
+}
+
+func NewItem(username, p string, size int64, hash, signature string) *Item {
+	return &Item{
+		QuarantineId: utils.GenerateUUID(),
+		UUsername:    username,
+		Path:         utils.CleanDrivePath(p),
+		Size:         size,
+		Hash:         hash,
+		Signature:    signature,
+		CreatedAt:    time.Now(),
+	}
+}
+
+func collection() *mongo.Collection {
+	return database.Collection(config.GetConfigDB().QuarantineColl)
+}
+
+// ContentKey returns the storage key the content of the item is kept under
+func (q *Item) ContentKey() string {
+	return path.Join(config.GetConfigDrive().QuarantineDir, q.QuarantineId)
+}
+
+func (q *Item) AddItemToDB() error {
+	_, err := collection().InsertOne(context.Background(), q)
+	return err
+}
+
+func GetItem(quarantineId string) (*Item, error) {
+	var q Item
+	err := collection().FindOne(context.Background(), bson.M{"quarantine_id": quarantineId}).Decode(&q)
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// GetItems returns the quarantined uploads of username, or of every user
+// when it is empty, most recent first
+func GetItems(username string) ([]Item, error) {
+	filter := bson.M{}
+	if username != "" {
+		filter["u_username"] = username
+	}
+
+	items := []Item{}
+	cursor, err := collection().Find(context.Background(), filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.Background(), &items)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// TakeItem removes the item from the quarantine and returns it to the request
+// releasing or deleting it, so that it is handled only once. Its content stays
+// until DeleteContent is called. It returns mongo.ErrNoDocuments when there is
+// no such item to take.
+func TakeItem(quarantineId string) (*Item, error) {
+	var q Item
+	err := collection().FindOneAndDelete(context.Background(), bson.M{"quarantine_id": quarantineId}).Decode(&q)
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// DeleteContent removes the content of an item taken with TakeItem
+func (q *Item) DeleteContent() error {
+	return storage.GetStorage().Delete(context.Background(), q.ContentKey())
+}
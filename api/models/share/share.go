@@ -0,0 +1,278 @@
+package share
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/database"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxResumes is how many resumable downloads are remembered for a share
+const maxResumes = 50
+
+// Share is a link that gives anyone holding its token access to a file or folder of a drive
+type Share struct {
+	Token        string     `json:"token" bson:"token"`
+	UUsername    string     `json:"u_username" bson:"u_username"`
+	Path         string     `json:"path" bson:"path"`
+	IsDir        bool       `json:"is_dir" bson:"is_dir"`
+	PasswordHash string     `json:"-" bson:"password_hash,omitempty"`
+	HasPassword  bool       `json:"has_password" bson:"has_password"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	MaxDownloads int64      `json:"max_downloads" bson:"max_downloads"` // 0 means unlimited
+	Downloads    int64      `json:"downloads" bson:"downloads"`
+	Resumes      []Resume   `json:"-" bson:"resumes,omitempty"`
+	CreatedAt    time.Time  `json:"created_at" bson:"created_at"`
+}
+
+// Resume lets a client continue a download of a limited share that was
+// already counted. Every byte of the content is served once per download.
+type Resume struct {
+	IP      string `bson:"ip"`
+	Path    string `bson:"path"`
+	Version string `bson:"version"` // the content the download was made of
+	Next    int64  `bson:"next"`    // first byte the client didn't get
+}
+
+// AccessLog records one request made with a share link
+type AccessLog struct {
+	Token     string    `json:"token" bson:"token"`
+	UUsername string    `json:"u_username" bson:"u_username"` // owner of the share
+	Path      string    `json:"path" bson:"path"`
+	IP        string    `json:"ip" bson:"ip"`
+	UserAgent string    `json:"user_agent" bson:"user_agent"`
+	Action    string    `json:"action" bson:"action"` // list or download
+	Status    int       `json:"status" bson:"status"`
+	Time      time.Time `json:"time" bson:"time"`
+}
+
+func NewShare(username, p string, isDir bool) (*Share, error) {
+	token, err := utils.GenerateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Share{
+		Token:     token,
+		UUsername: username,
+		Path:      utils.CleanDrivePath(p),
+		IsDir:     isDir,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// SetPassword protects the share, an empty password removes the protection
+func (s *Share) SetPassword(password string) error {
+	s.PasswordHash, s.HasPassword = "", false
+	if password == "" {
+		return nil
+	}
+
+	hash, err := utils.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	s.PasswordHash, s.HasPassword = hash, true
+	return nil
+}
+
+// CheckPassword reports whether password opens the share
+func (s *Share) CheckPassword(password string) bool {
+	return !s.HasPassword || utils.CheckPasswordHash(password, s.PasswordHash)
+}
+
+// Expired reports whether the share can't be used anymore at now
+func (s *Share) Expired(now time.Time) bool {
+	return s.ExpiresAt != nil && !now.Before(*s.ExpiresAt)
+}
+
+func collection() *mongo.Collection {
+	return database.Collection(config.GetConfigDB().ShareColl)
+}
+
+func logCollection() *mongo.Collection {
+	return database.Collection(config.GetConfigDB().ShareLogColl)
+}
+
+// CreateIndexes makes sure tokens are unique and the logs of a share are fast to read
+func CreateIndexes() error {
+	_, err := collection().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "u_username", Value: 1}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = logCollection().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "token", Value: 1}, {Key: "time", Value: -1}},
+	})
+	return err
+}
+
+func (s *Share) AddShareToDB() error {
+	_, err := collection().InsertOne(context.Background(), s)
+	return err
+}
+
+func GetShare(token string) (*Share, error) {
+	var s Share
+	err := collection().FindOne(context.Background(), bson.M{"token": token}).Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// GetShares returns the shares of a user, most recent first
+func GetShares(username string) ([]Share, error) {
+	shares := []Share{}
+	cursor, err := collection().Find(context.Background(),
+		bson.M{"u_username": username},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.Background(), &shares)
+	if err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+// DeleteShare revokes a share of the user, it returns mongo.ErrNoDocuments when there is none
+func DeleteShare(username, token string) error {
+	res, err := collection().DeleteOne(context.Background(),
+		bson.M{"u_username": username, "token": token})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	_, err = logCollection().DeleteMany(context.Background(), bson.M{"token": token})
+	return err
+}
+
+// DeleteTreeShares revokes the shares of p and of everything below it, so
+// nothing stored later at those paths is reached with their tokens
+func DeleteTreeShares(username, p string) error {
+	filter := database.TreeFilter(username, p)
+	tokens, err := collection().Distinct(context.Background(), "token", filter)
+	if err != nil || len(tokens) == 0 {
+		return err
+	}
+
+	if _, err := collection().DeleteMany(context.Background(), filter); err != nil {
+		return err
+	}
+	_, err = logCollection().DeleteMany(context.Background(), bson.M{"token": bson.M{"$in": tokens}})
+	return err
+}
+
+// CountDownload uses one download of the share. It reports false
+// when the share has no downloads left or is gone.
+func (s *Share) CountDownload() (bool, error) {
+	filter := bson.M{"token": s.Token}
+	if s.MaxDownloads > 0 {
+		filter["downloads"] = bson.M{"$lt": s.MaxDownloads}
+	}
+
+	res, err := collection().UpdateOne(context.Background(), filter,
+		bson.M{"$inc": bson.M{"downloads": 1}})
+	if err != nil {
+		return false, err
+	}
+	if res.MatchedCount == 0 {
+		return false, nil
+	}
+	s.Downloads++
+	return true, nil
+}
+
+// MoveShares updates the shares of oldPath and of everything below it to newPath
+func MoveShares(username, oldPath, newPath string) error {
+	oldPath = utils.CleanDrivePath(oldPath)
+	newPath = utils.CleanDrivePath(newPath)
+
+	cursor, err := collection().Find(context.Background(), database.TreeFilter(username, oldPath))
+	if err != nil {
+		return err
+	}
+
+	shares := []Share{}
+	if err := cursor.All(context.Background(), &shares); err != nil {
+		return err
+	}
+
+	for _, s := range shares {
+		_, err := collection().UpdateOne(context.Background(),
+			bson.M{"token": s.Token},
+			bson.M{"$set": bson.M{"path": newPath + strings.TrimPrefix(s.Path, oldPath)}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *AccessLog) AddAccessLogToDB() error {
+	_, err := logCollection().InsertOne(context.Background(), l)
+	return err
+}
+
+// GetAccessLogs returns the latest accesses made with a share of the user, most recent first
+func GetAccessLogs(username, token string, limit int64) ([]AccessLog, error) {
+	logs := []AccessLog{}
+	cursor, err := logCollection().Find(context.Background(),
+		bson.M{"u_username": username, "token": token},
+		options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.Background(), &logs)
+	if err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// UseResume takes the resume of a download of p by ip, if there is one the
+// range starting at start continues without serving any byte twice.
+// It reports whether the request resumes a counted download.
+func (s *Share) UseResume(ip, p, version string, start int64) (bool, error) {
+	match := bson.M{"ip": ip, "path": p, "version": version, "next": bson.M{"$lte": start}}
+	res, err := collection().UpdateOne(context.Background(),
+		bson.M{"token": s.Token, "resumes": bson.M{"$elemMatch": match}},
+		bson.M{"$pull": bson.M{"resumes": match}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// AddResume remembers that ip got p up to next, it may continue from there.
+// Only the latest resumes of the share are kept.
+func (s *Share) AddResume(ip, p, version string, next int64) error {
+	_, err := collection().UpdateOne(context.Background(),
+		bson.M{"token": s.Token},
+		bson.M{"$push": bson.M{"resumes": bson.M{
+			"$each":  []Resume{{IP: ip, Path: p, Version: version, Next: next}},
+			"$slice": -maxResumes,
+		}}})
+	return err
+}
@@ -0,0 +1,68 @@
+package thumb
+
+import (
+	"context"
+	"time"
+
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Thumb is a cached JPEG thumbnail of an image. Thumbnails are small, so they
+// are kept in the database next to the file metadata rather than in the storage.
+type Thumb struct {
+	ContentId string    `json:"content_id" bson:"content_id"` // hash of the image content
+	Size      int       `json:"size" bson:"size"`
+	Data      []byte    `json:"-" bson:"data"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+func NewThumb(contentId string, size int, data []byte) *Thumb {
+	return &Thumb{
+		ContentId: contentId,
+		Size:      size,
+		Data:      data,
+		CreatedAt: time.Now(),
+	}
+}
+
+func collection() *mongo.Collection {
+	return database.Collection(config.GetConfigDB().ThumbColl)
+}
+
+// CreateIndexes makes sure a thumbnail is cached once per content and size
+func CreateIndexes() error {
+	_, err := collection().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "content_id", Value: 1}, {Key: "size", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// AddThumbToDB caches the thumbnail, replacing one made concurrently
+func (t *Thumb) AddThumbToDB() error {
+	_, err := collection().ReplaceOne(context.Background(),
+		bson.M{"content_id": t.ContentId, "size": t.Size},
+		t,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+func GetThumb(contentId string, size int) (*Thumb, error) {
+	var t Thumb
+	err := collection().FindOne(context.Background(),
+		bson.M{"content_id": contentId, "size": size}).Decode(&t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// DeleteThumbs removes every thumbnail of a content
+func DeleteThumbs(contentId string) error {
+	_, err := collection().DeleteMany(context.Background(), bson.M{"content_id": contentId})
+	return err
+}
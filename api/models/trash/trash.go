@@ -0,0 +1,211 @@
+package trash
+
+import (
+	"context"
+	"errors"
+	"path"
+	"time"
+
+	"github.com/poriamsz55/distork/api/models/blob"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/user"
+	"github.com/poriamsz55/distork/api/models/version"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/database"
+	"github.com/poriamsz55/distork/storage"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// purgeTimeout is how long a purge may hold an item, a purge that failed
+// or was interrupted is retried once it has passed
+const purgeTimeout = 10 * time.Minute
+
+// ErrItemTaken is returned when another request is restoring or purging the item
+var ErrItemTaken = errors.New("Trash item is being restored or purged")
+
+// TrashItem is a file or folder deleted from a drive, kept until it is restored or purged
+type TrashItem struct {
+	TrashId   string      `json:"trash_id" bson:"trash_id"`
+	UUsername string      `json:"u_username" bson:"u_username"`
+	Filename  string      `json:"filename" bson:"filename"`
+	OrigPath  string      `json:"orig_path" bson:"orig_path"`
+	Size      int64       `json:"size" bson:"size"` // bytes of every file in the item
+	IsDir     bool        `json:"is_dir" bson:"is_dir"`
+	DeletedAt time.Time   `json:"deleted_at" bson:"deleted_at"`
+	ExpiresAt time.Time   `json:"expires_at" bson:"expires_at"`
+	Files     []file.File `json:"-" bson:"files"` // index entries of the item, used on restore
+	PurgingAt time.Time   `json:"-" bson:"purging_at,omitempty"`
+}
+
+func NewTrashItem(username, role string, tree []file.File) *TrashItem {
+	now := time.Now()
+	return &TrashItem{
+		TrashId:   utils.GenerateUUID(),
+		UUsername: username,
+		Filename:  tree[0].Filename,
+		OrigPath:  tree[0].Path,
+		Size:      file.TreeSize(tree),
+		IsDir:     tree[0].IsDir,
+		DeletedAt: now,
+		ExpiresAt: now.Add(config.RoleTrashRetention[role]),
+		Files:     tree,
+	}
+}
+
+func collection() *mongo.Collection {
+	return database.Collection(config.GetConfigDB().TrashColl)
+}
+
+// ItemKey returns the storage key the content of a trashed item is kept under
+func ItemKey(username, trashId string) string {
+	return path.Join(config.GetConfigDrive().TrashDir, username, trashId)
+}
+
+func (t *TrashItem) AddTrashItemToDB() error {
+	_, err := collection().InsertOne(context.Background(), t)
+	return err
+}
+
+func (t *TrashItem) DeleteTrashItemFromDB() error {
+	_, err := collection().DeleteOne(context.Background(),
+		bson.M{"u_username": t.UUsername, "trash_id": t.TrashId})
+	return err
+}
+
+func GetTrashItem(username, trashId string) (*TrashItem, error) {
+	var t TrashItem
+	err := collection().FindOne(context.Background(),
+		bson.M{"u_username": username, "trash_id": trashId}).Decode(&t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// TakeTrashItem removes the item from the trash and returns it to the request
+// restoring it, so it is restored only once and never while it is purged.
+// It returns mongo.ErrNoDocuments when there is no such item to take.
+func TakeTrashItem(username, trashId string) (*TrashItem, error) {
+	var t TrashItem
+	err := collection().FindOneAndDelete(context.Background(), bson.M{
+		"u_username": username,
+		"trash_id":   trashId,
+		"purging_at": bson.M{"$exists": false},
+	}).Decode(&t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// claimPurge marks the item as being purged. It reports false when it was
+// restored or another purge holds it.
+func (t *TrashItem) claimPurge() (bool, error) {
+	now := time.Now()
+	result, err := collection().UpdateOne(context.Background(),
+		bson.M{
+			"u_username": t.UUsername,
+			"trash_id":   t.TrashId,
+			"$or": bson.A{
+				bson.M{"purging_at": bson.M{"$exists": false}},
+				bson.M{"purging_at": bson.M{"$lte": now.Add(-purgeTimeout)}},
+			},
+		},
+		bson.M{"$set": bson.M{"purging_at": now}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// GetTrashItems returns the trash of a user, most recently deleted first
+func GetTrashItems(username string) ([]TrashItem, error) {
+	return findTrashItems(bson.M{"u_username": username},
+		options.Find().SetSort(bson.D{{Key: "deleted_at", Value: -1}}))
+}
+
+// GetExpiredTrashItems returns the items of every user whose retention has passed
+func GetExpiredTrashItems(now time.Time) ([]TrashItem, error) {
+	return findTrashItems(bson.M{"expires_at": bson.M{"$lte": now}})
+}
+
+func findTrashItems(filter bson.M, opts ...*options.FindOptions) ([]TrashItem, error) {
+	items := []TrashItem{}
+	cursor, err := collection().Find(context.Background(), filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.Background(), &items)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// Purge permanently removes the item with the versions kept with it and
+// frees their bytes from the owner's drive. It returns ErrItemTaken when
+// the item is being restored or purged by another request.
+func (t *TrashItem) Purge() error {
+	done := user.BeginDriveChange(t.UUsername)
+	defer done()
+
+	claimed, err := t.claimPurge()
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return ErrItemTaken
+	}
+
+	// Versions go first, the item is still there when a failed purge is retried
+	versions, err := version.GetTrashedVersions(t.UUsername, t.TrashId)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		freed, err := v.Delete()
+		if err != nil {
+			return err
+		}
+		if err := user.IncDriveUsed(t.UUsername, -freed); err != nil {
+			return err
+		}
+	}
+
+	if err := storage.GetStorage().Delete(context.Background(), ItemKey(t.UUsername, t.TrashId)); err != nil {
+		return err
+	}
+
+	if err := t.DeleteTrashItemFromDB(); err != nil {
+		return err
+	}
+
+	if err := user.IncDriveUsed(t.UUsername, -t.Size); err != nil {
+		return err
+	}
+
+	// The entry is gone first: a failed release leaves an unused blob
+	// behind instead of releasing it twice on the next attempt
+	for _, f := range t.Files {
+		if f.Hash != "" {
+			if err := blob.Release(f.Hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// TrashUsage returns the bytes in the trash of username,
+// or of every user by username when it is empty
+func TrashUsage(username string) (map[string]int64, error) {
+	filter := bson.M{}
+	if username != "" {
+		filter["u_username"] = username
+	}
+	return database.SumByUser(collection(), filter, "size")
+}
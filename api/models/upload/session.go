@@ -0,0 +1,248 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/poriamsz55/distork/api/models/user"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/database"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	TypeSession = "session"
+
+	SessionReceiving  = "receiving"
+	SessionAssembling = "assembling"
+)
+
+// ErrSessionAssembling is returned when a session is aborted while its file is being stored
+var ErrSessionAssembling = errors.New("Upload session is being assembled")
+
+// UploadSession is a chunked upload whose chunks may arrive in any order.
+// The size of the file is reserved in the user's drive when the session starts.
+type UploadSession struct {
+	Type        string    `json:"type" bson:"type"`
+	UploadId    string    `json:"upload_id" bson:"upload_id"`
+	UUsername   string    `json:"u_username" bson:"u_username"`                 // owner of the drive the file goes to
+	Uploader    string    `json:"uploader,omitempty" bson:"uploader,omitempty"` // who sends it, when it isn't the owner
+	Path        string    `json:"path" bson:"path"`                             // drive folder the file goes to
+	Filename    string    `json:"filename" bson:"filename"`
+	Size        int64     `json:"size" bson:"size"`
+	ChunkSize   int64     `json:"chunk_size" bson:"chunk_size"`
+	TotalChunks int       `json:"total_chunks" bson:"total_chunks"`
+	SHA256      string    `json:"sha256" bson:"sha256"` // hex digest of the whole file
+	Mode        string    `json:"mode,omitempty" bson:"mode"`
+	Received    []int     `json:"received" bson:"received"`
+	Reserved    int64     `json:"reserved" bson:"reserved"` // bytes reserved in the user's drive
+	State       string    `json:"state" bson:"state"`
+	CreatedAt   time.Time `json:"created_at" bson:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+func NewUploadSession(username, dir, filename string, size, chunkSize int64, sha256 string) *UploadSession {
+	now := time.Now()
+	return &UploadSession{
+		Type:        TypeSession,
+		UploadId:    utils.GenerateUUID() + utils.GenerateUUID(),
+		UUsername:   username,
+		Path:        utils.CleanDrivePath(dir),
+		Filename:    filename,
+		Size:        size,
+		ChunkSize:   chunkSize,
+		TotalChunks: int((size + chunkSize - 1) / chunkSize),
+		SHA256:      sha256,
+		Received:    []int{},
+		State:       SessionReceiving,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(config.GetConfigDrive().UploadExpiration),
+	}
+}
+
+// Dir returns the folder holding the chunks received so far
+func (s *UploadSession) Dir() string {
+	return filepath.Join(config.GetConfigDrive().SessionDir, s.UploadId)
+}
+
+// ChunkPath returns where chunk n is stored
+func (s *UploadSession) ChunkPath(n int) string {
+	return filepath.Join(s.Dir(), strconv.Itoa(n))
+}
+
+// ChunkLength returns the number of bytes chunk n must have, only the last one can be shorter
+func (s *UploadSession) ChunkLength(n int) int64 {
+	if n == s.TotalChunks-1 {
+		return s.Size - int64(n)*s.ChunkSize
+	}
+	return s.ChunkSize
+}
+
+// ChunkRange is a run of consecutive chunks, First and Last included
+type ChunkRange struct {
+	First int `json:"first"`
+	Last  int `json:"last"`
+}
+
+// Missing returns the runs of chunks that have not been received yet
+func (s *UploadSession) Missing() []ChunkRange {
+	received := make(map[int]bool, len(s.Received))
+	for _, n := range s.Received {
+		received[n] = true
+	}
+
+	missing := []ChunkRange{}
+	for n := 0; n < s.TotalChunks; n++ {
+		if received[n] {
+			continue
+		}
+		if last := len(missing) - 1; last >= 0 && missing[last].Last == n-1 {
+			missing[last].Last = n
+		} else {
+			missing = append(missing, ChunkRange{First: n, Last: n})
+		}
+	}
+	return missing
+}
+
+func (s *UploadSession) AddUploadSessionToDB() error {
+	_, err := collection().InsertOne(context.Background(), s)
+	return err
+}
+
+// GetUploadSession returns a session to or by the user that has not expired yet
+func GetUploadSession(username, uploadId string) (*UploadSession, error) {
+	var s UploadSession
+	err := collection().FindOne(context.Background(), bson.M{
+		"type":       TypeSession,
+		"$or":        userFilter(username),
+		"upload_id":  uploadId,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// AddChunk records chunk n as received and returns the updated session
+func (s *UploadSession) AddChunk(n int) (*UploadSession, error) {
+	var updated UploadSession
+	err := collection().FindOneAndUpdate(context.Background(),
+		bson.M{"type": TypeSession, "upload_id": s.UploadId},
+		bson.M{
+			"$addToSet": bson.M{"received": n},
+			"$set":      bson.M{"expires_at": time.Now().Add(config.GetConfigDrive().UploadExpiration)},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// StartAssembling moves the session to the assembling state. It reports false
+// when another request already did, so the file is assembled only once.
+// The expiration is pushed back, the purger leaves the session to the
+// assembling request unless that one never finished.
+func (s *UploadSession) StartAssembling() (bool, error) {
+	result, err := collection().UpdateOne(context.Background(),
+		bson.M{"type": TypeSession, "upload_id": s.UploadId, "state": SessionReceiving},
+		bson.M{"$set": bson.M{
+			"state":      SessionAssembling,
+			"expires_at": time.Now().Add(config.GetConfigDrive().UploadExpiration),
+		}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// Delete removes the session and its chunks and gives the reserved space back.
+// It is meant for the request assembling the session, see Abort.
+func (s *UploadSession) Delete() error {
+	_, err := s.deleteWhere(bson.M{})
+	return err
+}
+
+// Abort deletes a session that is still receiving chunks. A session being
+// assembled is refused with ErrSessionAssembling: its reservation is about
+// to become the charge of the file.
+func (s *UploadSession) Abort() error {
+	deleted, err := s.deleteWhere(bson.M{"state": SessionReceiving})
+	if err != nil || deleted {
+		return err
+	}
+
+	exists, err := UploadExists(s.UploadId)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrSessionAssembling
+	}
+	return nil
+}
+
+// DeleteExpired deletes the session if it expired before now. Sessions
+// that received a chunk or started assembling meanwhile are kept.
+func (s *UploadSession) DeleteExpired(now time.Time) error {
+	_, err := s.deleteWhere(bson.M{"expires_at": bson.M{"$lte": now}})
+	return err
+}
+
+// deleteWhere removes the session if it matches filter, then its chunks and
+// reservation. It reports whether the session was removed.
+func (s *UploadSession) deleteWhere(filter bson.M) (bool, error) {
+	done := user.BeginDriveChange(s.UUsername)
+	defer done()
+
+	filter["type"] = TypeSession
+	filter["upload_id"] = s.UploadId
+	result, err := collection().DeleteOne(context.Background(), filter)
+	if err != nil || result.DeletedCount == 0 {
+		return false, err
+	}
+
+	// Only the request that removed the session releases its reservation
+	if s.Reserved > 0 {
+		if err := user.IncDriveUsed(s.UUsername, -s.Reserved); err != nil {
+			return true, err
+		}
+	}
+
+	// Chunks left behind are cleaned up by the part janitor
+	return true, os.RemoveAll(s.Dir())
+}
+
+// GetExpiredUploadSessions returns the sessions of every user that expired before now
+func GetExpiredUploadSessions(now time.Time) ([]UploadSession, error) {
+	sessions := []UploadSession{}
+	cursor, err := collection().Find(context.Background(),
+		bson.M{"type": TypeSession, "expires_at": bson.M{"$lte": now}})
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.Background(), &sessions)
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// ReservedUsage returns the bytes reserved by the tus uploads and upload sessions
+// of username, or of every user by username when it is empty
+func ReservedUsage(username string) (map[string]int64, error) {
+	filter := bson.M{}
+	if username != "" {
+		filter["u_username"] = username
+	}
+	return database.SumByUser(collection(), filter, "reserved")
+}
@@ -0,0 +1,24 @@
+package upload
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUploadSession_Missing(t *testing.T) {
+	tests := []struct {
+		received []int
+		missing  []ChunkRange
+	}{
+		{[]int{}, []ChunkRange{{0, 9}}},
+		{[]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, []ChunkRange{}},
+		{[]int{3, 0, 4}, []ChunkRange{{1, 2}, {5, 9}}},
+		{[]int{1, 9}, []ChunkRange{{0, 0}, {2, 8}}},
+	}
+	for _, tt := range tests {
+		s := &UploadSession{TotalChunks: 10, Received: tt.received}
+		if got := s.Missing(); !reflect.DeepEqual(got, tt.missing) {
+			t.Errorf("Missing() with %v received = %v, want %v", tt.received, got, tt.missing)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package upload
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/poriamsz55/distork/api/models/user"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/database"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const TypeTus = "tus"
+
+// tusLocks serializes the requests made to the same upload
+var tusLocks sync.Map
+
+// LockTusUpload waits until no other request works on the upload and returns
+// the function releasing it. The lock is dropped when the upload is deleted.
+func LockTusUpload(uploadId string) func() {
+	lock, _ := tusLocks.LoadOrStore(uploadId, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex).Unlock
+}
+
+// TusUpload is the state of a resumable upload made with the tus protocol.
+// Its length is reserved in the user's drive when it is created.
+type TusUpload struct {
+	Type      string            `json:"type" bson:"type"`
+	UploadId  string            `json:"upload_id" bson:"upload_id"`
+	UUsername string            `json:"u_username" bson:"u_username"`                 // owner of the drive the file goes to
+	Uploader  string            `json:"uploader,omitempty" bson:"uploader,omitempty"` // who sends it, when it isn't the owner
+	Path      string            `json:"path" bson:"path"`                             // drive folder the file goes to
+	Filename  string            `json:"filename" bson:"filename"`
+	Length    int64             `json:"length" bson:"length"`
+	Offset    int64             `json:"offset" bson:"offset"`
+	Reserved  int64             `json:"reserved" bson:"reserved"` // bytes reserved in the user's drive
+	Metadata  map[string]string `json:"metadata" bson:"metadata"`
+	CreatedAt time.Time         `json:"created_at" bson:"created_at"`
+	ExpiresAt time.Time         `json:"expires_at" bson:"expires_at"`
+}
+
+func NewTusUpload(username, dir, filename string, length int64, metadata map[string]string) *TusUpload {
+	now := time.Now()
+	return &TusUpload{
+		Type:      TypeTus,
+		UploadId:  utils.GenerateUUID() + utils.GenerateUUID(),
+		UUsername: username,
+		Path:      utils.CleanDrivePath(dir),
+		Filename:  filename,
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: now,
+		ExpiresAt: now.Add(config.GetConfigDrive().UploadExpiration),
+	}
+}
+
+func collection() *mongo.Collection {
+	return database.Collection(config.GetConfigDB().UploadColl)
+}
+
+// userFilter matches the uploads going to the drive of username or sent by username
+func userFilter(username string) []bson.M {
+	return []bson.M{{"u_username": username}, {"uploader": username}}
+}
+
+// UploadExists reports whether a tus upload or an upload session still owns uploadId
+func UploadExists(uploadId string) (bool, error) {
+	count, err := collection().CountDocuments(context.Background(), bson.M{"upload_id": uploadId})
+	return count > 0, err
+}
+
+// DataPath returns where the bytes received so far are stored
+func (t *TusUpload) DataPath() string {
+	return filepath.Join(config.GetConfigDrive().TusDir, t.UploadId)
+}
+
+func (t *TusUpload) AddTusUploadToDB() error {
+	_, err := collection().InsertOne(context.Background(), t)
+	return err
+}
+
+// GetTusUpload returns an upload to or by the user that has not expired yet
+func GetTusUpload(username, uploadId string) (*TusUpload, error) {
+	var t TusUpload
+	err := collection().FindOne(context.Background(), bson.M{
+		"type":       TypeTus,
+		"$or":        userFilter(username),
+		"upload_id":  uploadId,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// SetOffset records the bytes received and pushes the expiration back
+func (t *TusUpload) SetOffset(offset int64) error {
+	t.Offset = offset
+	t.ExpiresAt = time.Now().Add(config.GetConfigDrive().UploadExpiration)
+
+	_, err := collection().UpdateOne(context.Background(),
+		bson.M{"type": TypeTus, "upload_id": t.UploadId},
+		bson.M{"$set": bson.M{"offset": t.Offset, "expires_at": t.ExpiresAt}})
+	return err
+}
+
+// Delete removes the upload state and the data received and gives the reserved space back
+func (t *TusUpload) Delete() error {
+	done := user.BeginDriveChange(t.UUsername)
+	defer done()
+
+	if err := os.Remove(t.DataPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	result, err := collection().DeleteOne(context.Background(),
+		bson.M{"type": TypeTus, "upload_id": t.UploadId})
+	if err != nil {
+		return err
+	}
+	tusLocks.Delete(t.UploadId)
+
+	// Only the request that removed the upload releases its reservation
+	if result.DeletedCount == 1 && t.Reserved > 0 {
+		return user.IncDriveUsed(t.UUsername, -t.Reserved)
+	}
+	return nil
+}
+
+// GetExpiredTusUploads returns the uploads of every user that expired before now
+func GetExpiredTusUploads(now time.Time) ([]TusUpload, error) {
+	uploads := []TusUpload{}
+	cursor, err := collection().Find(context.Background(),
+		bson.M{"type": TypeTus, "expires_at": bson.M{"$lte": now}})
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.Background(), &uploads)
+	if err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
@@ -0,0 +1,62 @@
+package user
+
+import "sync"
+
+// DriveChangeMark tells whether the drive of a user changed between two
+// moments: the marks differ when a change started in between, and Active
+// is not zero while one is in progress
+type DriveChangeMark struct {
+	Active  int
+	Started uint64
+}
+
+// driveChanges counts the changes of every drive in progress in this process
+var driveChanges = struct {
+	sync.Mutex
+	marks map[string]DriveChangeMark
+}{marks: map[string]DriveChangeMark{}}
+
+// BeginDriveChange marks a change of the drive of username as in progress,
+// one that charges the drive and indexes what it holds in separate steps,
+// like an upload charged before its file is indexed. The quota reconciler
+// leaves such drives alone, their usage and index disagree until the change
+// is done. The returned function ends the change, it may be called twice.
+func BeginDriveChange(username string) func() {
+	driveChanges.Lock()
+	m := driveChanges.marks[username]
+	m.Active++
+	m.Started++
+	driveChanges.marks[username] = m
+	driveChanges.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			driveChanges.Lock()
+			defer driveChanges.Unlock()
+
+			m := driveChanges.marks[username]
+			m.Active--
+			driveChanges.marks[username] = m
+		})
+	}
+}
+
+// DriveChanges returns the mark of the drive of username
+func DriveChanges(username string) DriveChangeMark {
+	driveChanges.Lock()
+	defer driveChanges.Unlock()
+	return driveChanges.marks[username]
+}
+
+// AllDriveChanges returns the marks of every drive that ever changed
+func AllDriveChanges() map[string]DriveChangeMark {
+	driveChanges.Lock()
+	defer driveChanges.Unlock()
+
+	marks := make(map[string]DriveChangeMark, len(driveChanges.marks))
+	for username, m := range driveChanges.marks {
+		marks[username] = m
+	}
+	return marks
+}
@@ -11,6 +11,8 @@ import (
 	"github.com/poriamsz55/distork/database"
 	"github.com/poriamsz55/distork/utils"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type User struct {
@@ -34,6 +36,106 @@ func UpdateUser(username string, updateFields bson.M) error {
 	return err
 }
 
+// IncDriveUsed atomically adds delta bytes to the user's drive usage.
+// A negative delta frees space, the usage never drops below zero.
+func IncDriveUsed(username string, delta int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"username": username}
+	update := bson.A{
+		bson.M{"$set": bson.M{"drive_used": bson.M{
+			"$max": bson.A{0, bson.M{"$add": bson.A{"$drive_used", delta}}},
+		}}},
+	}
+
+	collection := database.Collection(config.GetConfigDB().UserColl)
+	_, err := collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// ReserveDrive atomically adds size bytes to the user's drive usage only if
+// they fit in the drive, so concurrent uploads can never overshoot its size
+// together. It reports whether the space was reserved, the reservation is
+// given back with a negative IncDriveUsed.
+func ReserveDrive(username string, size int64) (bool, error) {
+	if size <= 0 {
+		return true, IncDriveUsed(username, size)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"username": username,
+		"$expr": bson.M{"$lte": bson.A{
+			bson.M{"$add": bson.A{"$drive_used", size}}, "$drive_size",
+		}},
+	}
+	update := bson.M{"$inc": bson.M{"drive_used": size}}
+
+	collection := database.Collection(config.GetConfigDB().UserColl)
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// CorrectDriveUsed adds delta bytes to the user's drive usage only if it is
+// still recorded, so a correction never overwrites a concurrent change.
+// It reports whether the usage was corrected.
+func CorrectDriveUsed(username string, recorded, delta int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"username": username, "drive_used": recorded}
+	update := bson.M{"$inc": bson.M{"drive_used": delta}}
+
+	collection := database.Collection(config.GetConfigDB().UserColl)
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// SetDriveSize gives the user a drive of size bytes instead of the size of
+// the user's role. It returns mongo.ErrNoDocuments when there is no such user.
+func SetDriveSize(username string, size int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := database.Collection(config.GetConfigDB().UserColl)
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"username": username},
+		bson.M{"$set": bson.M{"drive_size": size}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// GetUsers returns every user, guests included, sorted by username
+func GetUsers() ([]User, error) {
+	users := []User{}
+	collection := database.Collection(config.GetConfigDB().UserColl)
+	cursor, err := collection.Find(context.Background(), bson.M{},
+		options.Find().SetSort(bson.D{{Key: "username", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.Background(), &users)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
 func NewUser(username, email, password, role string) *User {
 	pass, _ := utils.HashPassword(password)
 	usr := &User{
@@ -0,0 +1,85 @@
+package user
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/database"
+)
+
+// connectTestDB connects to an empty distork_test database on the local
+// MongoDB, e.g. DISTORK_TEST_MONGO=1 go test ./api/models/user/
+func connectTestDB(t *testing.T) {
+	if os.Getenv("DISTORK_TEST_MONGO") == "" {
+		t.Skip("DISTORK_TEST_MONGO is not set")
+	}
+
+	config.GetConfigDB().DatabaseName = "distork_test"
+	db, err := database.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Drop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Drop(context.Background()) })
+}
+
+// addTestUser records a user with a drive of driveSize bytes, driveUsed of them used
+func addTestUser(t *testing.T, username string, driveSize, driveUsed int64) {
+	usr := &User{Username: username, Role: "user", DriveSize: driveSize, DriveUsed: driveUsed}
+	if err := usr.AddUserToDB(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBeginDriveChange(t *testing.T) {
+	before := DriveChanges("alice")
+
+	done := BeginDriveChange("alice")
+	if m := DriveChanges("alice"); m.Active != before.Active+1 || m.Started != before.Started+1 {
+		t.Errorf("during a change, mark = %+v, was %+v", m, before)
+	}
+	if m := AllDriveChanges()["alice"]; m != DriveChanges("alice") {
+		t.Errorf("AllDriveChanges()[alice] = %+v, want %+v", m, DriveChanges("alice"))
+	}
+
+	done()
+	done()
+	if m := DriveChanges("alice"); m.Active != before.Active || m.Started != before.Started+1 {
+		t.Errorf("after the change, mark = %+v, was %+v", m, before)
+	}
+	if m := DriveChanges("bob"); m != (DriveChangeMark{}) {
+		t.Errorf("mark of an unchanged drive = %+v", m)
+	}
+}
+
+func TestCorrectDriveUsed(t *testing.T) {
+	connectTestDB(t)
+	addTestUser(t, "alice", 1000, 500)
+
+	// A stale recorded usage doesn't apply the correction
+	ok, err := CorrectDriveUsed("alice", 400, -300)
+	if err != nil || ok {
+		t.Fatalf("CorrectDriveUsed with a stale usage = %v, %v, want false", ok, err)
+	}
+	if usr, _ := GetUserByUsername("alice"); usr.DriveUsed != 500 {
+		t.Fatalf("DriveUsed = %d after a stale correction, want 500", usr.DriveUsed)
+	}
+
+	ok, err = CorrectDriveUsed("alice", 500, -300)
+	if err != nil || !ok {
+		t.Fatalf("CorrectDriveUsed = %v, %v, want true", ok, err)
+	}
+	if usr, _ := GetUserByUsername("alice"); usr.DriveUsed != 200 {
+		t.Fatalf("DriveUsed = %d, want 200", usr.DriveUsed)
+	}
+
+	// Nothing to correct for a user that doesn't exist
+	ok, err = CorrectDriveUsed("bob", 0, 100)
+	if err != nil || ok {
+		t.Fatalf("CorrectDriveUsed of a missing user = %v, %v, want false", ok, err)
+	}
+}
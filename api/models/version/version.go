@@ -0,0 +1,200 @@
+package version
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/poriamsz55/distork/api/models/blob"
+	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/database"
+	"github.com/poriamsz55/distork/storage"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Version is a previous content of a drive file, kept when the file was overwritten
+type Version struct {
+	VersionId string    `json:"version_id" bson:"version_id"`
+	UUsername string    `json:"u_username" bson:"u_username"`
+	Path      string    `json:"path" bson:"path"` // path of the file the version belongs to
+	Size      int64     `json:"size" bson:"size"`
+	ModTime   time.Time `json:"mod_time" bson:"mod_time"`     // modification time of the old content
+	CreatedAt time.Time `json:"created_at" bson:"created_at"` // when the content was replaced
+	Hash      string    `json:"hash,omitempty" bson:"hash,omitempty"`
+	MimeType  string    `json:"mime_type,omitempty" bson:"mime_type,omitempty"`
+	TrashId   string    `json:"-" bson:"trash_id,omitempty"` // set while the file is in the trash
+}
+
+// live matches the versions of files that are not in the trash
+var live = bson.M{"$exists": false}
+
+func NewVersion(username, p string, size int64, modTime time.Time, hash string) *Version {
+	return &Version{
+		VersionId: utils.GenerateUUID(),
+		UUsername: username,
+		Path:      utils.CleanDrivePath(p),
+		Size:      size,
+		ModTime:   modTime,
+		CreatedAt: time.Now(),
+		Hash:      hash,
+	}
+}
+
+func collection() *mongo.Collection {
+	return database.Collection(config.GetConfigDB().VersionColl)
+}
+
+// VersionKey returns the storage key the content of a version is kept under
+func VersionKey(username, versionId string) string {
+	return path.Join(config.GetConfigDrive().VersionDir, username, versionId)
+}
+
+// ContentKey returns the storage key the content of the version is kept under
+func (v *Version) ContentKey() string {
+	if v.Hash != "" {
+		return blob.BlobKey(v.Hash)
+	}
+	return VersionKey(v.UUsername, v.VersionId)
+}
+
+func (v *Version) AddVersionToDB() error {
+	_, err := collection().InsertOne(context.Background(), v)
+	return err
+}
+
+func (v *Version) DeleteVersionFromDB() error {
+	_, err := collection().DeleteOne(context.Background(),
+		bson.M{"u_username": v.UUsername, "version_id": v.VersionId})
+	return err
+}
+
+func GetVersion(username, p, versionId string) (*Version, error) {
+	var v Version
+	err := collection().FindOne(context.Background(), bson.M{
+		"u_username": username,
+		"path":       utils.CleanDrivePath(p),
+		"version_id": versionId,
+		"trash_id":   live,
+	}).Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// GetVersions returns the versions of a file, newest first
+func GetVersions(username, p string) ([]Version, error) {
+	return findVersions(bson.M{"u_username": username, "path": utils.CleanDrivePath(p), "trash_id": live})
+}
+
+// GetTreeVersions returns the versions of p and every file below it
+func GetTreeVersions(username, p string) ([]Version, error) {
+	filter := database.TreeFilter(username, p)
+	filter["trash_id"] = live
+	return findVersions(filter)
+}
+
+// GetTrashedVersions returns the versions kept with a trashed item
+func GetTrashedVersions(username, trashId string) ([]Version, error) {
+	return findVersions(bson.M{"u_username": username, "trash_id": trashId})
+}
+
+func findVersions(filter bson.M) ([]Version, error) {
+	versions := []Version{}
+	cursor, err := collection().Find(context.Background(), filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(context.Background(), &versions)
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// MoveVersions keeps the versions of a tree attached to it after a move or rename
+func MoveVersions(username, oldPath, newPath string) error {
+	oldPath = utils.CleanDrivePath(oldPath)
+	newPath = utils.CleanDrivePath(newPath)
+
+	versions, err := GetTreeVersions(username, oldPath)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		_, err := collection().UpdateOne(context.Background(),
+			bson.M{"u_username": username, "version_id": v.VersionId},
+			bson.M{"$set": bson.M{"path": newPath + strings.TrimPrefix(v.Path, oldPath)}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TrashVersions keeps the versions of p and every file below it with the
+// trash item p was moved to, they are hidden until it is restored
+func TrashVersions(username, p, trashId string) error {
+	filter := database.TreeFilter(username, p)
+	filter["trash_id"] = live
+	_, err := collection().UpdateMany(context.Background(), filter,
+		bson.M{"$set": bson.M{"trash_id": trashId}})
+	return err
+}
+
+// RestoreVersions attaches the versions kept with a trash item again to
+// the tree restored from origPath to restorePath
+func RestoreVersions(username, trashId, origPath, restorePath string) error {
+	versions, err := GetTrashedVersions(username, trashId)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		_, err := collection().UpdateOne(context.Background(),
+			bson.M{"u_username": username, "version_id": v.VersionId},
+			bson.M{
+				"$set":   bson.M{"path": restorePath + strings.TrimPrefix(v.Path, origPath)},
+				"$unset": bson.M{"trash_id": ""},
+			})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the version content and its entry. It returns the bytes freed.
+func (v *Version) Delete() (int64, error) {
+	var err error
+	if v.Hash != "" {
+		err = blob.Release(v.Hash)
+	} else {
+		err = storage.GetStorage().Delete(context.Background(), VersionKey(v.UUsername, v.VersionId))
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := v.DeleteVersionFromDB(); err != nil {
+		return 0, err
+	}
+	return v.Size, nil
+}
+
+// VersionUsage returns the bytes of the versions kept for username,
+// or for every user by username when it is empty
+func VersionUsage(username string) (map[string]int64, error) {
+	filter := bson.M{}
+	if username != "" {
+		filter["u_username"] = username
+	}
+	return database.SumByUser(collection(), filter, "size")
+}
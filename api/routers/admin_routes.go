@@ -0,0 +1,31 @@
+package router
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/handlers"
+)
+
+func AdminRoutes(e *echo.Group) {
+	// Abandoned upload parts
+	e.GET("/janitor", handlers.GetJanitorReports)
+	e.POST("/janitor/run", handlers.RunJanitor)
+
+	// Drive usage and quotas
+	e.GET("/usage", handlers.GetDriveUsage)
+	e.GET("/usage/reconcile", handlers.GetReconcileReports)
+	e.POST("/usage/reconcile", handlers.ReconcileUsage)
+	e.POST("/drive-size", handlers.SetDriveSize)
+
+	// Integrity of the stored files
+	e.GET("/integrity/scrub", handlers.GetScrubReports)
+	e.POST("/integrity/scrub", handlers.ScrubStorage)
+
+	// Uploads quarantined by the malware scanner
+	e.GET("/quarantine", handlers.ListQuarantinedUploads)
+	e.POST("/quarantine/release", handlers.ReleaseQuarantined)
+	e.POST("/quarantine/delete", handlers.DeleteQuarantined)
+
+	// Encryption at rest
+	e.GET("/storage/rekey", handlers.GetRekeyReports)
+	e.POST("/storage/rekey", handlers.RekeyStorage)
+}
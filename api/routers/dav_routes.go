@@ -0,0 +1,19 @@
+package router
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/handlers"
+)
+
+// davMethods are the methods of HTTP and its WebDAV extension
+var davMethods = []string{
+	http.MethodOptions, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete,
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+func DAVRoutes(e *echo.Group) {
+	e.Match(davMethods, "", handlers.DAV)
+	e.Match(davMethods, "/*", handlers.DAV)
+}
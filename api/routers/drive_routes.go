@@ -3,15 +3,65 @@ package router
 import (
 	"github.com/labstack/echo/v4"
 	"github.com/poriamsz55/distork/api/handlers"
+	middle "github.com/poriamsz55/distork/api/middlewares"
 )
 
 func UploadRoutes(e *echo.Group) {
 	e.POST("", handlers.UploadFileChunk)
 	e.POST("/upload", handlers.UploadFile)
+
+	// Upload sessions, chunks may arrive in any order
+	e.POST("/session", handlers.CreateUploadSession)
+	e.GET("/session/:id", handlers.GetUploadSession)
+	e.PUT("/session/:id/:chunk", handlers.UploadSessionChunk)
+	e.DELETE("/session/:id", handlers.DeleteUploadSession)
+
+	// Resumable uploads with the tus protocol
+	tus := e.Group("/tus", middle.TusMiddleware)
+	tus.OPTIONS("", handlers.TusOptions)
+	tus.POST("", handlers.TusCreate)
+	tus.HEAD("/:id", handlers.TusHead)
+	tus.PATCH("/:id", handlers.TusPatch)
+	tus.DELETE("/:id", handlers.TusDelete)
 }
 
 func DriveRoutes(e *echo.Group) {
 	e.GET("/files", handlers.ListFilesAndFolders)
+	e.GET("/search", handlers.SearchFiles)
 	e.GET("/download", handlers.DownloadFile)
+	e.HEAD("/download", handlers.DownloadFile)
+	e.GET("/download/zip", handlers.DownloadZip)
+	e.GET("/thumbnail", handlers.GetThumbnail)
 	e.GET("/delete", handlers.DeleteFile)
+
+	// Folder management
+	e.POST("/folder", handlers.CreateFolder)
+	e.POST("/rename", handlers.RenameFile)
+	e.POST("/move", handlers.MoveFile)
+	e.POST("/copy", handlers.CopyFile)
+
+	// Trash
+	e.GET("/trash", handlers.ListTrash)
+	e.POST("/trash/restore", handlers.RestoreTrash)
+	e.POST("/trash/empty", handlers.EmptyTrash)
+
+	// Uploads the scanner found malware in
+	e.GET("/quarantine", handlers.ListQuarantine)
+
+	// Versions
+	e.GET("/versions", handlers.ListVersions)
+	e.GET("/versions/download", handlers.DownloadVersion)
+	e.POST("/versions/restore", handlers.RestoreVersion)
+
+	// Share links
+	e.POST("/share", handlers.CreateShare)
+	e.GET("/shares", handlers.ListShares)
+	e.POST("/shares/revoke", handlers.RevokeShare)
+	e.GET("/shares/log", handlers.ListShareLogs)
+
+	// Access given to other users, their items are browsed with ?owner=
+	e.POST("/grant", handlers.CreateGrant)
+	e.GET("/grants", handlers.ListGrants)
+	e.POST("/grants/revoke", handlers.RevokeGrant)
+	e.GET("/shared", handlers.ListSharedWithMe)
 }
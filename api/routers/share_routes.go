@@ -0,0 +1,13 @@
+package router
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/handlers"
+)
+
+// ShareRoutes serves share links, they need no account
+func ShareRoutes(e *echo.Group) {
+	e.GET("/:token", handlers.OpenShare)
+	e.HEAD("/:token", handlers.OpenShare)
+	e.POST("/:token", handlers.OpenShare)
+}
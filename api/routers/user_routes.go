@@ -19,4 +19,10 @@ func UserRoutes(e *echo.Group) {
 
 	// Sign in
 	e.POST("/signin", handlers.SignIn)
+
+	// App passwords, to mount the drive over WebDAV. Signed in users only,
+	// the token is checked before the user is loaded.
+	e.POST("/app-passwords", handlers.CreateAppPassword, middle.CheckJWTMiddleware, middle.OptionalJWTMiddleware)
+	e.GET("/app-passwords", handlers.ListAppPasswords, middle.CheckJWTMiddleware, middle.OptionalJWTMiddleware)
+	e.POST("/app-passwords/revoke", handlers.RevokeAppPassword, middle.CheckJWTMiddleware, middle.OptionalJWTMiddleware)
 }
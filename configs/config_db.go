@@ -1,10 +1,21 @@
 package config
 
 type ConfigDB struct {
-	DatabaseName string
-	DistorkColl  string
-	UserColl     string
-	RoomColl     string
+	DatabaseName    string
+	DistorkColl     string
+	UserColl        string
+	RoomColl        string
+	FileColl        string
+	TrashColl       string
+	VersionColl     string
+	UploadColl      string
+	BlobColl        string
+	ShareColl       string
+	ShareLogColl    string
+	GrantColl       string
+	ThumbColl       string
+	AppPasswordColl string
+	QuarantineColl  string
 }
 
 var (
@@ -19,10 +30,21 @@ func GetConfigDB() *ConfigDB {
 	}
 
 	configDB = &ConfigDB{
-		DatabaseName: "distork",
-		DistorkColl:  "distork",
-		UserColl:     "users",
-		RoomColl:     "rooms",
+		DatabaseName:    "distork",
+		DistorkColl:     "distork",
+		UserColl:        "users",
+		RoomColl:        "rooms",
+		FileColl:        "files",
+		TrashColl:       "trash",
+		VersionColl:     "versions",
+		UploadColl:      "uploads",
+		BlobColl:        "blobs",
+		ShareColl:       "shares",
+		ShareLogColl:    "share_logs",
+		GrantColl:       "grants",
+		ThumbColl:       "thumbnails",
+		AppPasswordColl: "app_passwords",
+		QuarantineColl:  "quarantine",
 	}
 	return configDB
 }
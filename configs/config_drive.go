@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 const (
 	RoleAdmin = "admin"
 	RoleUser  = "user"
@@ -12,8 +14,50 @@ var RoleDriveSize = map[string]int64{
 	RoleGuest: 1 * 1024 * 1024 * 1024,  // 1 GB for guests
 }
 
+// RoleTrashRetention is how long deleted items stay in the trash before they are purged
+var RoleTrashRetention = map[string]time.Duration{
+	RoleAdmin: 30 * 24 * time.Hour, // 30 days for admin
+	RoleUser:  30 * 24 * time.Hour, // 30 days for regular users
+	RoleGuest: 7 * 24 * time.Hour,  // 7 days for guests
+}
+
+// RoleMaxVersions is how many previous versions are kept for each file
+var RoleMaxVersions = map[string]int{
+	RoleAdmin: 20, // 20 versions for admin
+	RoleUser:  10, // 10 versions for regular users
+	RoleGuest: 3,  // 3 versions for guests
+}
+
+// ThumbnailSizes are the sizes, in pixels, thumbnails of images are made in
+var ThumbnailSizes = []int{128, 256, 1024}
+
 type ConfigDrive struct {
-	UploadDir string
+	UploadDir           string
+	TrashDir            string
+	BlobDir             string // content of drive files, stored once per SHA-256
+	StagingDir          string // completed uploads being hashed before they are stored
+	TrashPurgeInterval  time.Duration
+	VersionDir          string
+	QuarantineDir       string // infected uploads waiting for an admin, outside every drive
+	TusDir              string // unfinished tus uploads
+	SessionDir          string // chunks of unfinished upload sessions
+	PartDir             string // parts of unfinished legacy chunk uploads
+	MaxChunkSize        int64
+	MaxSessionChunks    int           // chunks an upload session may be split into
+	TusMaxSize          int64         // largest tus upload, whatever room the drive has
+	ExtractMaxEntries   int           // entries an uploaded archive may hold
+	ExtractMaxSize      int64         // bytes an uploaded archive may extract to
+	ExtractMaxRatio     int64         // extracted bytes allowed per compressed byte
+	ListPageSize        int64         // entries of a folder listing page when the client doesn't ask
+	ListMaxPageSize     int64         // largest folder listing page a client may ask for
+	SearchPageSize      int64         // results of a search page when the client doesn't ask
+	SearchMaxPageSize   int64         // largest search page a client may ask for
+	PartMaxAge          time.Duration // chunk parts older than this are considered abandoned
+	JanitorInterval     time.Duration
+	UploadExpiration    time.Duration // unfinished uploads are removed after this much inactivity
+	UploadPurgeInterval time.Duration
+	ReconcileInterval   time.Duration // how often the recorded drive usage is checked against the index
+	ScrubInterval       time.Duration // how often every stored file is read back and checked against its checksum
 }
 
 var (
@@ -28,7 +72,32 @@ func GetConfigDrive() *ConfigDrive {
 	}
 
 	configDrive = &ConfigDrive{
-		UploadDir: "uploads",
+		UploadDir:           "uploads",
+		TrashDir:            "trash",
+		BlobDir:             "blobs",
+		StagingDir:          "staging",
+		TrashPurgeInterval:  time.Hour,
+		VersionDir:          "versions",
+		QuarantineDir:       "quarantine",
+		TusDir:              "tus",
+		SessionDir:          "sessions",
+		PartDir:             "parts",
+		MaxChunkSize:        100 * 1024 * 1024, // 100 MB
+		MaxSessionChunks:    10000,
+		TusMaxSize:          30 * 1024 * 1024 * 1024, // 30 GB, the largest drive
+		ExtractMaxEntries:   10000,
+		ExtractMaxSize:      10 * 1024 * 1024 * 1024, // 10 GB
+		ExtractMaxRatio:     100,
+		ListPageSize:        200,
+		ListMaxPageSize:     1000,
+		SearchPageSize:      50,
+		SearchMaxPageSize:   500,
+		PartMaxAge:          24 * time.Hour,
+		JanitorInterval:     time.Hour,
+		UploadExpiration:    24 * time.Hour,
+		UploadPurgeInterval: time.Hour,
+		ReconcileInterval:   6 * time.Hour,
+		ScrubInterval:       7 * 24 * time.Hour,
 	}
 	return configDrive
 }
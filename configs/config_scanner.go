@@ -0,0 +1,61 @@
+package config
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	ScannerNone  = "none"
+	ScannerClamd = "clamd"
+	ScannerFake  = "fake" // flags the EICAR test file only, to try scanning without a daemon
+)
+
+// What happens to uploads larger than the scanner takes. By default they are
+// stored without being scanned and logged, so that enabling a scanner doesn't
+// break large uploads. Refusing them is opt-in.
+const (
+	OversizeRefuse = "refuse" // they are refused
+	OversizeStore  = "store"  // they are stored without being scanned
+)
+
+// ConfigScanner selects how uploads are checked for malware before they reach a drive
+type ConfigScanner struct {
+	Driver       string
+	ClamdAddress string        // tcp://host:port or unix:///path/to/clamd.sock
+	Timeout      time.Duration // for scanning one upload
+	FailOpen     bool          // store uploads when the scanner can't be reached instead of refusing them
+	MaxSize      int64         // largest upload sent to the scanner, 0 for no limit. clamd refuses streams over its StreamMaxLength, 25 MB by default
+	Oversize     string        // OversizeRefuse or OversizeStore, for uploads larger than MaxSize
+}
+
+var (
+	configScanner *ConfigScanner
+)
+
+// GetConfigScanner returns the instance of ConfigScanner, loading it if it has not been loaded before
+func GetConfigScanner() *ConfigScanner {
+
+	if configScanner != nil {
+		return configScanner
+	}
+
+	failOpen, _ := strconv.ParseBool(getEnv("DISTORK_SCAN_FAIL_OPEN", "false"))
+	timeout, err := time.ParseDuration(getEnv("DISTORK_SCAN_TIMEOUT", "5m"))
+	if err != nil || timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	maxSize, err := strconv.ParseInt(getEnv("DISTORK_SCAN_MAX_SIZE", "26214400"), 10, 64) // 25 MB
+	if err != nil || maxSize < 0 {
+		maxSize = 25 * 1024 * 1024
+	}
+	configScanner = &ConfigScanner{
+		Driver:       getEnv("DISTORK_SCANNER", ScannerNone),
+		ClamdAddress: getEnv("DISTORK_CLAMD_ADDRESS", "tcp://localhost:3310"),
+		Timeout:      timeout,
+		FailOpen:     failOpen,
+		MaxSize:      maxSize,
+		Oversize:     getEnv("DISTORK_SCAN_OVERSIZE", OversizeStore),
+	}
+	return configScanner
+}
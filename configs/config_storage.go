@@ -0,0 +1,63 @@
+package config
+
+import (
+	"os"
+	"strconv"
+)
+
+const (
+	StorageLocal = "local"
+	StorageS3    = "s3"
+)
+
+// ConfigStorage selects where the bytes of drive files are kept.
+// Credentials are read from the environment so they stay out of the code.
+type ConfigStorage struct {
+	Driver      string
+	LocalRoot   string // keys of the local driver are relative to this folder
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	S3UseSSL    bool
+	// Master keys as "id:base64key,...", the first one encrypts new files and
+	// the others are only kept to read files until they are rekeyed.
+	// Files are stored in plaintext when it is empty.
+	EncryptionKeys string
+}
+
+var (
+	configStorage *ConfigStorage
+)
+
+// GetConfigStorage returns the instance of ConfigStorage, loading it if it has not been loaded before
+func GetConfigStorage() *ConfigStorage {
+
+	if configStorage != nil {
+		return configStorage
+	}
+
+	useSSL, _ := strconv.ParseBool(getEnv("DISTORK_S3_USE_SSL", "false"))
+	configStorage = &ConfigStorage{
+		Driver:      getEnv("DISTORK_STORAGE", StorageLocal),
+		LocalRoot:   getEnv("DISTORK_LOCAL_ROOT", "."),
+		S3Endpoint:  getEnv("DISTORK_S3_ENDPOINT", "localhost:9000"),
+		S3Region:    getEnv("DISTORK_S3_REGION", "us-east-1"),
+		S3Bucket:    getEnv("DISTORK_S3_BUCKET", "distork"),
+		S3AccessKey: os.Getenv("DISTORK_S3_ACCESS_KEY"),
+		S3SecretKey: os.Getenv("DISTORK_S3_SECRET_KEY"),
+		S3UseSSL:    useSSL,
+
+		EncryptionKeys: os.Getenv("DISTORK_ENCRYPTION_KEYS"),
+	}
+	return configStorage
+}
+
+// getEnv returns the environment variable key, or def when it is not set
+func getEnv(key, def string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return def
+}
@@ -3,9 +3,12 @@ package database
 import (
 	"context"
 	"log"
+	"regexp"
 	"time"
 
 	config "github.com/poriamsz55/distork/configs"
+	"github.com/poriamsz55/distork/utils"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -56,3 +59,44 @@ func Collection(name string) *mongo.Collection {
 	}
 	return DB.Collection(name)
 }
+
+// SumByUser adds up field over the documents of coll matching filter,
+// grouped by their owner in u_username
+func SumByUser(coll *mongo.Collection, filter bson.M, field string) (map[string]int64, error) {
+	cursor, err := coll.Aggregate(context.Background(), bson.A{
+		bson.M{"$match": filter},
+		bson.M{"$group": bson.M{"_id": "$u_username", "total": bson.M{"$sum": "$" + field}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []struct {
+		Username string `bson:"_id"`
+		Total    int64  `bson:"total"`
+	}
+	if err := cursor.All(context.Background(), &groups); err != nil {
+		return nil, err
+	}
+
+	totals := map[string]int64{}
+	for _, g := range groups {
+		totals[g.Username] = g.Total
+	}
+	return totals, nil
+}
+
+// TreeFilter matches the documents of username whose path is p or below it
+func TreeFilter(username, p string) bson.M {
+	p = utils.CleanDrivePath(p)
+	if p == "/" {
+		return bson.M{"u_username": username}
+	}
+	return bson.M{
+		"u_username": username,
+		"$or": []bson.M{
+			{"path": p},
+			{"path": bson.M{"$regex": "^" + regexp.QuoteMeta(p+"/")}},
+		},
+	}
+}
@@ -2,30 +2,83 @@ package main
 
 import (
 	"log"
-	"os"
 
 	"github.com/labstack/echo/v4"
+	"github.com/poriamsz55/distork/api/jobs"
 	middle "github.com/poriamsz55/distork/api/middlewares"
+	"github.com/poriamsz55/distork/api/models/apppass"
+	"github.com/poriamsz55/distork/api/models/blob"
 	"github.com/poriamsz55/distork/api/models/distork"
+	"github.com/poriamsz55/distork/api/models/file"
+	"github.com/poriamsz55/distork/api/models/grant"
+	"github.com/poriamsz55/distork/api/models/share"
+	"github.com/poriamsz55/distork/api/models/thumb"
 	"github.com/poriamsz55/distork/api/models/user"
 	router "github.com/poriamsz55/distork/api/routers"
 	config "github.com/poriamsz55/distork/configs"
 	"github.com/poriamsz55/distork/database"
+	"github.com/poriamsz55/distork/scanner"
+	"github.com/poriamsz55/distork/storage"
 )
 
 func main() {
-	// Create upload directory if it doesn't exist
-	if _, err := os.Stat(config.GetConfigDrive().UploadDir); os.IsNotExist(err) {
-		os.MkdirAll(config.GetConfigDrive().UploadDir, os.ModePerm)
+	// Open the storage the drive files are kept in
+	err := storage.Init()
+	if err != nil {
+		log.Fatalf("Error when opening storage: %s", err)
+		return
+	}
+
+	// Uploads are checked for malware before they reach a drive
+	if err := scanner.Init(); err != nil {
+		log.Fatalf("Error when setting up the malware scanner: %s", err)
+		return
 	}
 
-	_, err := database.Connect()
+	_, err = database.Connect()
 	defer database.Disconnect()
 	if err != nil {
 		log.Fatalf("Error when opening file: %s", err)
 		return
 	}
 
+	// Build the drive index from the files already in the storage
+	err = file.CreateIndexes()
+	if err != nil {
+		log.Fatalf("Error when creating file indexes: %s", err)
+		return
+	}
+	err = blob.CreateIndexes()
+	if err != nil {
+		log.Fatalf("Error when creating blob indexes: %s", err)
+		return
+	}
+	err = share.CreateIndexes()
+	if err != nil {
+		log.Fatalf("Error when creating share indexes: %s", err)
+		return
+	}
+	err = grant.CreateIndexes()
+	if err != nil {
+		log.Fatalf("Error when creating grant indexes: %s", err)
+		return
+	}
+	err = thumb.CreateIndexes()
+	if err != nil {
+		log.Fatalf("Error when creating thumbnail indexes: %s", err)
+		return
+	}
+	err = apppass.CreateIndexes()
+	if err != nil {
+		log.Fatalf("Error when creating app password indexes: %s", err)
+		return
+	}
+	err = file.IndexUploads()
+	if err != nil {
+		log.Fatalf("Error when indexing uploads: %s", err)
+		return
+	}
+
 	usr := user.NewUser("admin",
 		"admin@mail.com",
 		"admin",
@@ -36,6 +89,13 @@ func main() {
 		return
 	}
 
+	// Background jobs
+	go jobs.RunTrashPurger(config.GetConfigDrive().TrashPurgeInterval)
+	go jobs.RunUploadPurger(config.GetConfigDrive().UploadPurgeInterval)
+	go jobs.RunPartJanitor(config.GetConfigDrive().JanitorInterval)
+	go jobs.RunQuotaReconciler(config.GetConfigDrive().ReconcileInterval)
+	go jobs.RunIntegrityScrubber(config.GetConfigDrive().ScrubInterval)
+
 	e := echo.New()
 
 	setupApp(e)
@@ -69,6 +129,21 @@ func setupApp(e *echo.Echo) {
 	middle.JWTMiddleWares(driveGroup)
 	router.DriveRoutes(driveGroup)
 
+	// WebDAV, drives mounted in file managers
+	davGroup := eGroup.Group("/dav")
+	middle.DAVMiddleWares(davGroup)
+	router.DAVRoutes(davGroup)
+
+	// Admin Routes
+	adminGroup := eGroup.Group("/admin")
+	middle.JWTMiddleWares(adminGroup)
+	middle.AdminMiddleWares(adminGroup)
+	router.AdminRoutes(adminGroup)
+
+	// Share links, no authentication
+	shareGroup := eGroup.Group("/s")
+	router.ShareRoutes(shareGroup)
+
 	// User Routes
 	userGroup := eGroup.Group("/user")
 	router.UserRoutes(userGroup)
@@ -0,0 +1,148 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// clamdChunkSize is the most bytes sent to clamd in one INSTREAM chunk
+const clamdChunkSize = 64 * 1024
+
+// Clamd scans content with a ClamAV daemon. The content is streamed with the
+// INSTREAM command, so clamd doesn't need access to the files. Streams larger
+// than its StreamMaxLength are refused by clamd and reported as errors.
+type Clamd struct {
+	Network string // "tcp" or "unix"
+	Address string
+}
+
+// NewClamd parses the address of a daemon, tcp://host:port, unix:///path or host:port
+func NewClamd(address string) (*Clamd, error) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		return &Clamd{Network: "unix", Address: strings.TrimPrefix(address, "unix://")}, nil
+	case strings.HasPrefix(address, "tcp://"):
+		address = strings.TrimPrefix(address, "tcp://")
+	case strings.Contains(address, "://"):
+		return nil, fmt.Errorf("scanner: unsupported clamd address %q", address)
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("scanner: invalid clamd address %q: %w", address, err)
+	}
+	return &Clamd{Network: "tcp", Address: address}, nil
+}
+
+func (c *Clamd) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	// The whole exchange gives up with the context
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// readReply returns a reply of clamd without its terminator
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(err == io.EOF && reply != "") {
+		return "", err
+	}
+	return strings.TrimRight(reply, "\x00\n"), nil
+}
+
+// Ping checks the daemon answers
+func (c *Clamd) Ping(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return err
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("scanner: unexpected clamd reply %q", reply)
+	}
+	return nil
+}
+
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (*Result, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, err
+	}
+
+	// Every chunk is prefixed with its length, an empty chunk ends the stream
+	chunk := make([]byte, 4+clamdChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk[:4], uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				// clamd closes the connection when the stream is over its limit,
+				// its reply says so
+				if reply, replyErr := readReply(conn); replyErr == nil {
+					return parseClamdReply(reply)
+				}
+				return nil, err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return nil, err
+	}
+	return parseClamdReply(reply)
+}
+
+// parseClamdReply reads the answer to INSTREAM, "stream: OK",
+// "stream: <signature> FOUND" or "<message> ERROR"
+func parseClamdReply(reply string) (*Result, error) {
+	// Results are prefixed with the name of what was scanned, errors aren't
+	status := reply
+	if _, rest, ok := strings.Cut(reply, ": "); ok {
+		status = rest
+	}
+
+	switch {
+	case status == "OK":
+		return &Result{}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return &Result{Infected: true, Signature: strings.TrimSuffix(status, " FOUND")}, nil
+	case strings.HasSuffix(status, " ERROR"):
+		return nil, errors.New("scanner: clamd: " + strings.TrimSuffix(status, " ERROR"))
+	}
+	return nil, fmt.Errorf("scanner: unexpected clamd reply %q", reply)
+}
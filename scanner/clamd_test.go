@@ -0,0 +1,150 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveClamd answers INSTREAM commands on l the way clamd does, with the
+// verdict of a Fake
+func serveClamd(l net.Listener, maxStream int) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			cmd, err := r.ReadString(0)
+			if err != nil {
+				return
+			}
+			if cmd == "zPING\x00" {
+				conn.Write([]byte("PONG\x00"))
+				return
+			}
+			if cmd != "zINSTREAM\x00" {
+				conn.Write([]byte("UNKNOWN COMMAND\x00"))
+				return
+			}
+
+			var stream bytes.Buffer
+			for {
+				var size uint32
+				if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+					return
+				}
+				if size == 0 {
+					break
+				}
+				if _, err := io.CopyN(&stream, r, int64(size)); err != nil {
+					return
+				}
+				if stream.Len() > maxStream {
+					conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+					return
+				}
+			}
+
+			res, _ := NewFake().Scan(context.Background(), &stream)
+			if res.Infected {
+				conn.Write([]byte("stream: " + res.Signature + " FOUND\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+		}()
+	}
+}
+
+func testClamd(t *testing.T, c *Clamd, maxStream int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	clean := strings.Repeat("harmless ", 20000) // several chunks
+	if res, err := c.Scan(ctx, strings.NewReader(clean)); err != nil || res.Infected {
+		t.Errorf("clean content = %+v, %v", res, err)
+	}
+
+	infected := append([]byte("prefix "), eicar...)
+	res, err := c.Scan(ctx, bytes.NewReader(infected))
+	if err != nil || !res.Infected || res.Signature == "" {
+		t.Errorf("EICAR = %+v, %v, want infected", res, err)
+	}
+
+	if maxStream > 0 {
+		big := bytes.Repeat([]byte{'a'}, maxStream+2*clamdChunkSize)
+		if res, err := c.Scan(ctx, bytes.NewReader(big)); err == nil {
+			t.Errorf("stream over the limit = %+v, want an error", res)
+		}
+	}
+}
+
+func TestClamd(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveClamd(l, 1<<20)
+
+	c, err := NewClamd("tcp://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testClamd(t, c, 1<<20)
+}
+
+// TestClamdDaemon runs against a real daemon, e.g.
+// DISTORK_TEST_CLAMD=tcp://localhost:3310 go test ./scanner/
+func TestClamdDaemon(t *testing.T) {
+	address := os.Getenv("DISTORK_TEST_CLAMD")
+	if address == "" {
+		t.Skip("DISTORK_TEST_CLAMD is not set")
+	}
+
+	c, err := NewClamd(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testClamd(t, c, 0)
+}
+
+func TestNewClamd(t *testing.T) {
+	tests := []struct {
+		address string
+		network string
+		addr    string
+		err     bool
+	}{
+		{address: "tcp://localhost:3310", network: "tcp", addr: "localhost:3310"},
+		{address: "clamav:3310", network: "tcp", addr: "clamav:3310"},
+		{address: "unix:///run/clamav/clamd.ctl", network: "unix", addr: "/run/clamav/clamd.ctl"},
+		{address: "http://localhost:3310", err: true},
+		{address: "localhost", err: true},
+	}
+	for _, tt := range tests {
+		c, err := NewClamd(tt.address)
+		if tt.err {
+			if err == nil {
+				t.Errorf("NewClamd(%q) = %+v, want an error", tt.address, c)
+			}
+			continue
+		}
+		if err != nil || c.Network != tt.network || c.Address != tt.addr {
+			t.Errorf("NewClamd(%q) = %+v, %v", tt.address, c, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// eicar is the EICAR test file, every scanner reports it as malware.
+// It is split in two so this source file isn't flagged itself.
+var eicar = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$` + `EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+// Fake reports content holding one of its patterns as infected. It stands in
+// for a real scanner in tests and on machines without one.
+type Fake struct {
+	Signatures map[string][]byte // patterns by the signature they are reported as
+	Err        error             // returned by every scan when set, like an unreachable daemon
+}
+
+// NewFake returns a scanner that only knows the EICAR test file
+func NewFake() *Fake {
+	return &Fake{Signatures: map[string][]byte{"Eicar-Test-Signature": eicar}}
+}
+
+// Scan reads r once, keeping only the bytes that may start a pattern
+// split between two reads, so large uploads are not held in memory
+func (f *Fake) Scan(ctx context.Context, r io.Reader) (*Result, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	longest := 1
+	for _, pattern := range f.Signatures {
+		longest = max(longest, len(pattern))
+	}
+
+	buf := make([]byte, 32*1024)
+	var window []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		n, readErr := r.Read(buf)
+		window = append(window, buf[:n]...)
+		for signature, pattern := range f.Signatures {
+			if bytes.Contains(window, pattern) {
+				return &Result{Infected: true, Signature: signature}, nil
+			}
+		}
+		if keep := longest - 1; len(window) > keep {
+			window = append(window[:0], window[len(window)-keep:]...)
+		}
+
+		if readErr == io.EOF {
+			return &Result{}, nil
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFake(t *testing.T) {
+	f := NewFake()
+	padding := bytes.Repeat([]byte("a"), 100*1024)
+
+	tests := []struct {
+		name     string
+		content  []byte
+		infected bool
+	}{
+		{"empty", nil, false},
+		{"clean", padding, false},
+		{"eicar", eicar, true},
+		{"eicar after a large prefix", append(append([]byte{}, padding...), eicar...), true},
+		{"truncated eicar", append(append([]byte{}, padding...), eicar[:len(eicar)-1]...), false},
+	}
+	for _, tt := range tests {
+		// One byte at a time, the pattern arrives split over many reads
+		res, err := f.Scan(context.Background(), iotest.OneByteReader(bytes.NewReader(tt.content)))
+		if err != nil || res.Infected != tt.infected {
+			t.Errorf("%s byte by byte: %+v, %v, want infected = %v", tt.name, res, err, tt.infected)
+		}
+
+		res, err = f.Scan(context.Background(), bytes.NewReader(tt.content))
+		if err != nil || res.Infected != tt.infected {
+			t.Errorf("%s in large reads: %+v, %v, want infected = %v", tt.name, res, err, tt.infected)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	config "github.com/poriamsz55/distork/configs"
+)
+
+// Result is what a scanner found in some content
+type Result struct {
+	Infected  bool   `json:"infected"`
+	Signature string `json:"signature,omitempty"` // name of the malware found, e.g. "Win.Test.EICAR_HDB-1"
+}
+
+// Scanner checks content for malware. An error means the content could not
+// be scanned, it says nothing about the content itself.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (*Result, error)
+}
+
+var (
+	defaultScanner Scanner
+	initOnce       sync.Once
+	initErr        error
+)
+
+// Init creates the scanner selected in the configuration
+func Init() error {
+	initOnce.Do(func() {
+		cfg := config.GetConfigScanner()
+		if cfg.Oversize != config.OversizeRefuse && cfg.Oversize != config.OversizeStore {
+			initErr = fmt.Errorf("scanner: unknown oversize policy %q", cfg.Oversize)
+			return
+		}
+
+		switch cfg.Driver {
+		case config.ScannerNone, "":
+		case config.ScannerClamd:
+			defaultScanner, initErr = NewClamd(cfg.ClamdAddress)
+		case config.ScannerFake:
+			defaultScanner = NewFake()
+		default:
+			initErr = fmt.Errorf("scanner: unknown driver %q", cfg.Driver)
+		}
+	})
+	return initErr
+}
+
+// GetScanner returns the scanner uploads go through, nil when scanning is disabled
+func GetScanner() Scanner {
+	return defaultScanner
+}
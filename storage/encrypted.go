@@ -0,0 +1,593 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Objects written by Encrypted start with a header
+//
+//	magic       8 bytes, "DSTKENC1"
+//	frame size  4 bytes, big endian, plaintext bytes in every frame but the last
+//	key id      1 byte of length and 32 bytes, zero padded, of the master key
+//	nonce       12 bytes the data key was sealed with
+//	data key    32 bytes sealed with the master key, with its 16 bytes tag
+//
+// followed by the content split in frames, each sealed with AES-GCM under the
+// data key of the object. A frame is found from a plaintext offset without
+// reading the ones before it, so ranged reads only fetch the frames they need.
+//
+// Objects stored before encryption was enabled may start with the magic too.
+// An object is only taken as sealed when its whole header is well formed and
+// authenticates under the master key it names, anything else is plaintext.
+const (
+	sealMagic      = "DSTKENC1"
+	maxKeyIdLen    = 32
+	dataKeyLen     = 32
+	tagSize        = 16
+	nonceSize      = 12
+	maxFrameSize   = 16 * 1024 * 1024
+	headerAADLen   = 8 + 4 + 1 + maxKeyIdLen // magic, frame size and key id
+	sealHeaderSize = headerAADLen + nonceSize + dataKeyLen + tagSize
+
+	// DefaultFrameSize is the plaintext bytes in a frame of new objects
+	DefaultFrameSize = 64 * 1024
+)
+
+// ErrSealBroken is returned when an encrypted object fails authentication,
+// it was damaged or changed outside of the drive
+var ErrSealBroken = errors.New("storage: encrypted object failed authentication")
+
+// MasterKey wraps the data keys of encrypted objects
+type MasterKey struct {
+	Id  string
+	Key []byte // 32 bytes, AES-256
+}
+
+// ParseMasterKeys reads master keys written as "id:base64key" separated by
+// commas, e.g. "2024b:...,2024a:...". The first one is the current key.
+func ParseMasterKeys(s string) ([]MasterKey, error) {
+	var keys []MasterKey
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("storage: master key %q has no id", item)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("storage: master key %q is not base64: %w", id, err)
+		}
+		keys = append(keys, MasterKey{Id: id, Key: key})
+	}
+	return keys, nil
+}
+
+// Encrypted seals the objects of another storage. Every object gets a data
+// key of its own, wrapped by the current master key and kept in the header.
+// Objects stored before encryption was enabled are read as they are until
+// Rekey encrypts them.
+type Encrypted struct {
+	inner     Storage
+	keys      []MasterKey // the first one wraps the data keys of new objects
+	FrameSize int
+}
+
+func NewEncrypted(inner Storage, keys []MasterKey) (*Encrypted, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("storage: no master key")
+	}
+
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if k.Id == "" || len(k.Id) > maxKeyIdLen {
+			return nil, fmt.Errorf("storage: master key id %q must have 1 to %d bytes", k.Id, maxKeyIdLen)
+		}
+		if len(k.Key) != 32 {
+			return nil, fmt.Errorf("storage: master key %q must have 32 bytes", k.Id)
+		}
+		if seen[k.Id] {
+			return nil, fmt.Errorf("storage: master key %q is given twice", k.Id)
+		}
+		seen[k.Id] = true
+	}
+
+	return &Encrypted{inner: inner, keys: keys, FrameSize: DefaultFrameSize}, nil
+}
+
+// CurrentKeyId returns the id of the master key new objects are sealed with
+func (e *Encrypted) CurrentKeyId() string {
+	return e.keys[0].Id
+}
+
+func (e *Encrypted) masterKey(id string) ([]byte, error) {
+	for _, k := range e.keys {
+		if k.Id == id {
+			return k.Key, nil
+		}
+	}
+	return nil, fmt.Errorf("storage: master key %q is not configured", id)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealHeader returns the header of an object with the given data key,
+// wrapped by the current master key
+func (e *Encrypted) sealHeader(frameSize int, dataKey []byte) ([]byte, error) {
+	current := e.keys[0]
+	header := make([]byte, headerAADLen, sealHeaderSize)
+	copy(header, sealMagic)
+	binary.BigEndian.PutUint32(header[len(sealMagic):], uint32(frameSize))
+	header[len(sealMagic)+4] = byte(len(current.Id))
+	copy(header[len(sealMagic)+5:], current.Id)
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(current.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The id and frame size are authenticated with the data key
+	aad := bytes.Clone(header)
+	header = append(header, nonce...)
+	return gcm.Seal(header, nonce, dataKey, aad), nil
+}
+
+// sealInfo is what the header of an encrypted object tells
+type sealInfo struct {
+	frameSize int
+	keyId     string
+	dataKey   []byte // nil until unwrapped
+}
+
+// parseHeader reads a header without unwrapping the data key, it returns
+// nil when the object was not stored encrypted
+func parseHeader(header []byte) *sealInfo {
+	if len(header) < sealHeaderSize || string(header[:len(sealMagic)]) != sealMagic {
+		return nil
+	}
+	idLen := int(header[len(sealMagic)+4])
+	frameSize := int(binary.BigEndian.Uint32(header[len(sealMagic):]))
+	if idLen == 0 || idLen > maxKeyIdLen || frameSize == 0 || frameSize > maxFrameSize {
+		return nil
+	}
+	// The key id is zero padded
+	for _, b := range header[len(sealMagic)+5+idLen : headerAADLen] {
+		if b != 0 {
+			return nil
+		}
+	}
+	return &sealInfo{
+		frameSize: frameSize,
+		keyId:     string(header[len(sealMagic)+5 : len(sealMagic)+5+idLen]),
+	}
+}
+
+// unwrap opens the data key of a header with the master key it names
+func (e *Encrypted) unwrap(header []byte, info *sealInfo) error {
+	key, err := e.masterKey(info.keyId)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	nonce := header[headerAADLen : headerAADLen+nonceSize]
+	dataKey, err := gcm.Open(nil, nonce, header[headerAADLen+nonceSize:sealHeaderSize], header[:headerAADLen])
+	if err != nil {
+		return ErrSealBroken
+	}
+	info.dataKey = dataKey
+	return nil
+}
+
+// sealedSize returns the bytes stored for size bytes of plaintext.
+// Even an empty object has a frame, so it can't be cut off unnoticed.
+func sealedSize(size int64, frameSize int) int64 {
+	fs := int64(frameSize)
+	frames := max(1, (size+fs-1)/fs)
+	return int64(sealHeaderSize) + size + frames*tagSize
+}
+
+// openedSize returns the plaintext bytes of an object of rawSize bytes
+func openedSize(rawSize int64, frameSize int) int64 {
+	body := rawSize - sealHeaderSize
+	frames := (body + int64(frameSize) + tagSize - 1) / (int64(frameSize) + tagSize)
+	return max(0, body-frames*tagSize)
+}
+
+// The nonce of a frame is its index, data keys are never shared by two objects
+func frameNonce(index int64) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce[nonceSize-8:], uint64(index))
+	return nonce
+}
+
+// The last frame is sealed differently so an object can't be truncated at a frame boundary
+func frameAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// sealedObject is an object found in the inner storage
+type sealedObject struct {
+	raw  *ObjectInfo
+	seal *sealInfo // nil for objects stored in plaintext
+}
+
+func (o *sealedObject) size() int64 {
+	if o.seal == nil {
+		return o.raw.Size
+	}
+	return openedSize(o.raw.Size, o.seal.frameSize)
+}
+
+// open reads the header of key and unwraps its data key
+func (e *Encrypted) open(ctx context.Context, key string) (*sealedObject, error) {
+	raw, err := e.inner.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return e.openInfo(ctx, raw)
+}
+
+// openInfo tells whether the object described by raw is sealed. A header that
+// doesn't authenticate was never written by Encrypted, it is plaintext that
+// happens to start like one. A header naming a master key that isn't
+// configured is an error: the object was sealed with a key dropped too early.
+func (e *Encrypted) openInfo(ctx context.Context, raw *ObjectInfo) (*sealedObject, error) {
+	obj := &sealedObject{raw: raw}
+	if raw.Size < sealHeaderSize {
+		return obj, nil
+	}
+
+	r, err := e.inner.Get(ctx, raw.Key, 0, sealHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	header := make([]byte, sealHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	obj.seal = parseHeader(header)
+	if obj.seal == nil {
+		return obj, nil
+	}
+	err = e.unwrap(header, obj.seal)
+	if err == ErrSealBroken {
+		obj.seal = nil
+		return obj, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (e *Encrypted) Put(ctx context.Context, key string, r io.Reader, size int64) (int64, error) {
+	sealed, rawSize, sealer, err := e.seal(r, size)
+	if err != nil {
+		return 0, err
+	}
+	_, err = e.inner.Put(ctx, key, sealed, rawSize)
+	return sealer.n, err
+}
+
+// seal returns the sealed content of size bytes read from r, under a new data
+// key, and its size. The sealer counts the plaintext bytes read.
+func (e *Encrypted) seal(r io.Reader, size int64) (io.Reader, int64, *sealReader, error) {
+	dataKey := make([]byte, dataKeyLen)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, 0, nil, err
+	}
+	header, err := e.sealHeader(e.FrameSize, dataKey)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	sealer := &sealReader{gcm: gcm, r: r, frame: make([]byte, e.FrameSize), out: make([]byte, 0, e.FrameSize+tagSize)}
+	rawSize := int64(-1)
+	if size >= 0 {
+		rawSize = sealedSize(size, e.FrameSize)
+	}
+	return io.MultiReader(bytes.NewReader(header), sealer), rawSize, sealer, nil
+}
+
+func (e *Encrypted) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	obj, err := e.open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if obj.seal == nil {
+		return e.inner.Get(ctx, key, offset, length)
+	}
+
+	size := obj.size()
+	end := size
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+	if offset >= end {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	// Fetch the frames holding the range and nothing else
+	fs := int64(obj.seal.frameSize)
+	first, last := offset/fs, (end-1)/fs
+	start := sealHeaderSize + first*(fs+tagSize)
+	stop := min(obj.raw.Size, sealHeaderSize+(last+1)*(fs+tagSize))
+	body, err := e.inner.Get(ctx, key, start, stop-start)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(obj.seal.dataKey)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	return &openReader{
+		gcm:       gcm,
+		body:      body,
+		frame:     make([]byte, fs+tagSize),
+		frameSize: fs,
+		index:     first,
+		lastIndex: max(0, (size-1)/fs),
+		rawSize:   obj.raw.Size,
+		skip:      offset - first*fs,
+		left:      end - offset,
+	}, nil
+}
+
+func (e *Encrypted) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	obj, err := e.open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: obj.raw.Key, Size: obj.size(), ModTime: obj.raw.ModTime}, nil
+}
+
+// List reads the header of every object to tell its plaintext size
+func (e *Encrypted) List(ctx context.Context, key string) ([]ObjectInfo, error) {
+	objects, err := e.inner.List(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range objects {
+		obj, err := e.openInfo(ctx, &objects[i])
+		if err == ErrNotExist {
+			continue // deleted since it was listed
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects[i].Size = obj.size()
+	}
+	return objects, nil
+}
+
+// Delete and Move never need the content, sealed objects keep their data key
+func (e *Encrypted) Delete(ctx context.Context, key string) error {
+	return e.inner.Delete(ctx, key)
+}
+
+func (e *Encrypted) Move(ctx context.Context, src, dst string) error {
+	return e.inner.Move(ctx, src, dst)
+}
+
+// Rekey makes sure key is sealed with the current master key. The data key
+// of an object sealed with an older master key is wrapped again and its
+// frames are copied as they are, the content is not encrypted again.
+// An object stored in plaintext is encrypted. It reports whether the object
+// was rewritten. The object is only replaced if it is still the one that was
+// read, one moved, deleted or rewritten meanwhile is left alone with ErrChanged.
+func (e *Encrypted) Rekey(ctx context.Context, key string) (bool, error) {
+	replacer, ok := e.inner.(Replacer)
+	if !ok {
+		return false, errors.New("storage: objects can't be rewritten in place")
+	}
+
+	obj, err := e.open(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	if obj.seal == nil {
+		r, err := e.inner.Get(ctx, key, 0, -1)
+		if err != nil {
+			return false, err
+		}
+		defer r.Close()
+
+		sealed, rawSize, _, err := e.seal(r, obj.raw.Size)
+		if err != nil {
+			return false, err
+		}
+		_, err = replacer.Replace(ctx, key, obj.raw, sealed, rawSize)
+		return err == nil, err
+	}
+
+	if obj.seal.keyId == e.CurrentKeyId() {
+		return false, nil
+	}
+
+	header, err := e.sealHeader(obj.seal.frameSize, obj.seal.dataKey)
+	if err != nil {
+		return false, err
+	}
+
+	frames, err := e.inner.Get(ctx, key, sealHeaderSize, -1)
+	if err != nil {
+		return false, err
+	}
+	defer frames.Close()
+
+	_, err = replacer.Replace(ctx, key, obj.raw, io.MultiReader(bytes.NewReader(header), frames), obj.raw.Size)
+	return err == nil, err
+}
+
+// sealReader encrypts r frame by frame. It reads one byte ahead to know
+// which frame is the last one.
+type sealReader struct {
+	gcm     cipher.AEAD
+	r       io.Reader
+	frame   []byte
+	out     []byte
+	sealed  []byte // sealed bytes not read yet
+	index   int64
+	peek    byte
+	hasPeek bool
+	done    bool
+	n       int64 // plaintext bytes read from r
+}
+
+func (s *sealReader) Read(p []byte) (int, error) {
+	for len(s.sealed) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.sealed)
+	s.sealed = s.sealed[n:]
+	return n, nil
+}
+
+func (s *sealReader) sealNext() error {
+	start := 0
+	if s.hasPeek {
+		s.frame[0] = s.peek
+		s.hasPeek = false
+		start = 1
+	}
+
+	n, err := io.ReadFull(s.r, s.frame[start:])
+	n += start
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		var b [1]byte
+		_, err := io.ReadFull(s.r, b[:])
+		if err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		} else {
+			s.peek = b[0]
+			s.hasPeek = true
+		}
+	}
+
+	s.n += int64(n)
+	s.sealed = s.gcm.Seal(s.out[:0], frameNonce(s.index), s.frame[:n], frameAAD(last))
+	s.index++
+	s.done = last
+	return nil
+}
+
+// openReader decrypts the frames of a ranged read and returns the bytes asked for
+type openReader struct {
+	gcm       cipher.AEAD
+	body      io.ReadCloser
+	frame     []byte
+	frameSize int64
+	index     int64 // of the next frame in body
+	lastIndex int64 // of the last frame of the object
+	rawSize   int64
+	skip      int64 // bytes of the next frame before the range
+	left      int64 // bytes of the range not returned yet
+	plain     []byte
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 {
+		if o.left == 0 {
+			return 0, io.EOF
+		}
+		if err := o.openNext(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+	return n, nil
+}
+
+func (o *openReader) openNext() error {
+	sealedLen := o.frameSize + tagSize
+	if o.index == o.lastIndex {
+		sealedLen = o.rawSize - sealHeaderSize - o.index*(o.frameSize+tagSize)
+	}
+	if sealedLen < tagSize {
+		return ErrSealBroken
+	}
+
+	sealed := o.frame[:sealedLen]
+	if _, err := io.ReadFull(o.body, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrSealBroken
+		}
+		return err
+	}
+
+	plain, err := o.gcm.Open(sealed[:0], frameNonce(o.index), sealed, frameAAD(o.index == o.lastIndex))
+	if err != nil {
+		return ErrSealBroken
+	}
+	o.index++
+
+	plain = plain[min(o.skip, int64(len(plain))):]
+	o.skip = 0
+	if int64(len(plain)) > o.left {
+		plain = plain[:o.left]
+	}
+	o.left -= int64(len(plain))
+	o.plain = plain
+	return nil
+}
+
+func (o *openReader) Close() error {
+	return o.body.Close()
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testMasterKey(id string, b byte) MasterKey {
+	return MasterKey{Id: id, Key: bytes.Repeat([]byte{b}, 32)}
+}
+
+func newTestEncrypted(t *testing.T, inner Storage, keys ...MasterKey) *Encrypted {
+	t.Helper()
+	e, err := NewEncrypted(inner, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Small frames so short contents span several of them
+	e.FrameSize = 4
+	return e
+}
+
+func readAll(t *testing.T, s Storage, key string, offset, length int64) (string, error) {
+	t.Helper()
+	r, err := s.Get(context.Background(), key, offset, length)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	return string(data), err
+}
+
+func TestEncrypted(t *testing.T) {
+	inner, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, newTestEncrypted(t, inner, testMasterKey("a", 1)))
+}
+
+func TestEncryptedRanges(t *testing.T) {
+	inner, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEncrypted(t, inner, testMasterKey("a", 1))
+	ctx := context.Background()
+
+	for _, content := range []string{"", "abc", "abcd", "abcdefghijklmnop", "abcdefghijklmnopq"} {
+		if _, err := e.Put(ctx, "k", strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+
+		raw, _ := inner.Stat(ctx, "k")
+		if raw.Size != sealedSize(int64(len(content)), e.FrameSize) {
+			t.Errorf("%q: stored %d bytes, want %d", content, raw.Size, sealedSize(int64(len(content)), e.FrameSize))
+		}
+		if info, err := e.Stat(ctx, "k"); err != nil || info.Size != int64(len(content)) {
+			t.Errorf("%q: stat = %v, %v", content, info, err)
+		}
+
+		for offset := 0; offset <= len(content); offset++ {
+			for length := -1; offset+length <= len(content); length++ {
+				want := content[offset:]
+				if length >= 0 {
+					want = content[offset : offset+length]
+				}
+				if got, err := readAll(t, e, "k", int64(offset), int64(length)); err != nil || got != want {
+					t.Errorf("%q: get(%d, %d) = %q, %v, want %q", content, offset, length, got, err, want)
+				}
+			}
+		}
+	}
+}
+
+func TestEncryptedTampering(t *testing.T) {
+	root := t.TempDir()
+	inner, err := NewLocal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEncrypted(t, inner, testMasterKey("a", 1))
+	ctx := context.Background()
+
+	content := "attack at dawn, not at dusk"
+	if _, err := e.Put(ctx, "k", strings.NewReader(content), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(root, "k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("dawn")) {
+		t.Fatal("the content is stored in plaintext")
+	}
+
+	// A flipped bit in a frame
+	flipped := bytes.Clone(stored)
+	flipped[len(flipped)-20] ^= 1
+	os.WriteFile(filepath.Join(root, "k"), flipped, 0644)
+	if _, err := readAll(t, e, "k", 0, -1); err != ErrSealBroken {
+		t.Errorf("get of a changed frame = %v, want ErrSealBroken", err)
+	}
+
+	// Whole frames cut off the end
+	cut := stored[:sealHeaderSize+2*(e.FrameSize+tagSize)]
+	os.WriteFile(filepath.Join(root, "k"), cut, 0644)
+	if _, err := readAll(t, e, "k", 0, -1); err != ErrSealBroken {
+		t.Errorf("get of a truncated object = %v, want ErrSealBroken", err)
+	}
+}
+
+func TestEncryptedRekey(t *testing.T) {
+	root := t.TempDir()
+	inner, err := NewLocal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Written before encryption was enabled
+	inner.Put(ctx, "plain", strings.NewReader("stored in the clear"), -1)
+
+	old := newTestEncrypted(t, inner, testMasterKey("a", 1))
+	if got, err := readAll(t, old, "plain", 0, -1); err != nil || got != "stored in the clear" {
+		t.Fatalf("plaintext object = %q, %v", got, err)
+	}
+	if _, err := old.Put(ctx, "sealed", strings.NewReader("sealed with the old key"), -1); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(filepath.Join(root, "sealed"))
+
+	rotated := newTestEncrypted(t, inner, testMasterKey("b", 2), testMasterKey("a", 1))
+	for _, key := range []string{"plain", "sealed"} {
+		if ok, err := rotated.Rekey(ctx, key); !ok || err != nil {
+			t.Fatalf("rekey of %s = %v, %v", key, ok, err)
+		}
+		if ok, err := rotated.Rekey(ctx, key); ok || err != nil {
+			t.Errorf("second rekey of %s = %v, %v, want nothing to do", key, ok, err)
+		}
+	}
+
+	// Only the header changed, the frames were copied as they are
+	after, _ := os.ReadFile(filepath.Join(root, "sealed"))
+	if !bytes.Equal(before[sealHeaderSize:], after[sealHeaderSize:]) {
+		t.Error("rekey encrypted the content again")
+	}
+
+	// The old key is not needed anymore
+	current := newTestEncrypted(t, inner, testMasterKey("b", 2))
+	if got, err := readAll(t, current, "sealed", 0, -1); err != nil || got != "sealed with the old key" {
+		t.Errorf("rekeyed object = %q, %v", got, err)
+	}
+	if got, err := readAll(t, current, "plain", 0, -1); err != nil || got != "stored in the clear" {
+		t.Errorf("encrypted plaintext object = %q, %v", got, err)
+	}
+}
+
+func TestEncryptedPlaintextWithMagic(t *testing.T) {
+	root := t.TempDir()
+	inner, err := NewLocal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Stored before encryption was enabled, one of them with a well formed
+	// header that doesn't authenticate
+	forged := make([]byte, sealHeaderSize+10)
+	copy(forged, sealMagic)
+	forged[len(sealMagic)+3] = 4
+	forged[len(sealMagic)+4] = 1
+	forged[len(sealMagic)+5] = 'a'
+	contents := map[string]string{
+		"text":   sealMagic + " is how sealed objects start, this file is not one of them",
+		"forged": string(forged),
+	}
+	for key, content := range contents {
+		inner.Put(ctx, key, strings.NewReader(content), -1)
+	}
+
+	e := newTestEncrypted(t, inner, testMasterKey("a", 1))
+	for key, content := range contents {
+		if got, err := readAll(t, e, key, 0, -1); err != nil || got != content {
+			t.Errorf("plaintext %s = %q, %v", key, got, err)
+		}
+		if info, err := e.Stat(ctx, key); err != nil || info.Size != int64(len(content)) {
+			t.Errorf("stat of plaintext %s = %+v, %v", key, info, err)
+		}
+
+		if ok, err := e.Rekey(ctx, key); !ok || err != nil {
+			t.Fatalf("rekey of %s = %v, %v", key, ok, err)
+		}
+		if got, err := readAll(t, e, key, 0, -1); err != nil || got != content {
+			t.Errorf("rekeyed plaintext %s = %q, %v", key, got, err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Local keeps objects as files below a root folder
+type Local struct {
+	Root string
+
+	// Held shared by every change and exclusively by Replace
+	// between checking an object and renaming over it
+	mu sync.RWMutex
+}
+
+func NewLocal(root string) (*Local, error) {
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &Local{Root: root}, nil
+}
+
+func (l *Local) path(key string) string {
+	return filepath.Join(l.Root, filepath.FromSlash(Key(key)))
+}
+
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64) (int64, error) {
+	dst := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return 0, err
+	}
+
+	// Write next to the destination and rename, readers never see a half written file
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".put-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return n, os.Rename(tmp.Name(), dst)
+}
+
+// Replace writes next to the object and renames over it only if its size
+// and modification time are still the ones of old
+func (l *Local) Replace(ctx context.Context, key string, old *ObjectInfo, r io.Reader, size int64) (int64, error) {
+	dst := l.path(key)
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".put-*")
+	if os.IsNotExist(err) {
+		return 0, ErrChanged
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	info, err := os.Stat(dst)
+	if os.IsNotExist(err) {
+		return n, ErrChanged
+	}
+	if err != nil {
+		return n, err
+	}
+	if info.IsDir() || info.Size() != old.Size || !info.ModTime().Equal(old.ModTime) {
+		return n, ErrChanged
+	}
+	return n, os.Rename(tmp.Name(), dst)
+}
+
+func (l *Local) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := os.Stat(l.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+
+	// Folders are not objects
+	if info.IsDir() {
+		return nil, ErrNotExist
+	}
+
+	return &ObjectInfo{Key: Key(key), Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *Local) List(ctx context.Context, key string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	err := filepath.WalkDir(l.path(key), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// skip folders and the temporary files of unfinished puts
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".put-") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.Root, p)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Key: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return os.RemoveAll(l.path(key))
+}
+
+func (l *Local) Move(ctx context.Context, src, dst string) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	dstPath := l.path(dst)
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	err := os.Rename(l.path(src), dstPath)
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	}
+	return err
+}
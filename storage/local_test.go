@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		elem []string
+		want string
+	}{
+		{elem: []string{"uploads", "alice", "/docs/a.txt"}, want: "uploads/alice/docs/a.txt"},
+		{elem: []string{"uploads", "alice", "/"}, want: "uploads/alice"},
+		{elem: []string{"uploads", "alice", "../../etc/passwd"}, want: "uploads/alice/etc/passwd"},
+		{elem: []string{"/trash/"}, want: "trash"},
+	}
+	for _, tt := range tests {
+		if got := Key(tt.elem...); got != tt.want {
+			t.Errorf("Key(%q) = %q, want %q", tt.elem, got, tt.want)
+		}
+	}
+}
+
+// testStorage runs the behavior every driver must share
+func testStorage(t *testing.T, s Storage) {
+	ctx := context.Background()
+	put := func(key, content string) {
+		t.Helper()
+		if _, err := s.Put(ctx, key, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(key string, offset, length int64) string {
+		t.Helper()
+		r, err := s.Get(ctx, key, offset, length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	put("u/alice/docs/a.txt", "0123456789")
+	put("u/alice/docs/sub/b.txt", "bb")
+	put("u/alice/docs2/c.txt", "c")
+
+	if got := get("u/alice/docs/a.txt", 2, 3); got != "234" {
+		t.Errorf("ranged get = %q, want %q", got, "234")
+	}
+	if got := get("u/alice/docs/a.txt", 7, -1); got != "789" {
+		t.Errorf("get to the end = %q, want %q", got, "789")
+	}
+
+	info, err := s.Stat(ctx, "u/alice/docs/a.txt")
+	if err != nil || info.Size != 10 {
+		t.Fatalf("stat = %v, %v", info, err)
+	}
+	if _, err := s.Stat(ctx, "u/alice/missing"); err != ErrNotExist {
+		t.Errorf("stat of a missing key = %v, want ErrNotExist", err)
+	}
+
+	// "docs" must not match "docs2"
+	objects, err := s.List(ctx, "u/alice/docs")
+	if err != nil || len(objects) != 2 {
+		t.Fatalf("list = %v, %v, want 2 objects", objects, err)
+	}
+
+	if err := s.Move(ctx, "u/alice/docs", "u/alice/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("u/alice/moved/sub/b.txt", 0, -1); got != "bb" {
+		t.Errorf("moved content = %q, want %q", got, "bb")
+	}
+	if err := s.Move(ctx, "u/alice/docs", "u/alice/again"); err != ErrNotExist {
+		t.Errorf("move of a missing key = %v, want ErrNotExist", err)
+	}
+
+	n, err := Copy(ctx, s, "u/alice/moved", "u/alice/copy")
+	if err != nil || n != 12 {
+		t.Fatalf("copy = %d, %v, want 12 bytes", n, err)
+	}
+
+	if err := s.Delete(ctx, "u/alice"); err != nil {
+		t.Fatal(err)
+	}
+	if objects, _ := s.List(ctx, "u"); len(objects) != 0 {
+		t.Errorf("objects left after delete: %v", objects)
+	}
+}
+
+// testReplace checks a driver only replaces objects that didn't change
+func testReplace(t *testing.T, s interface {
+	Storage
+	Replacer
+}) {
+	ctx := context.Background()
+	put := func(key, content string) *ObjectInfo {
+		t.Helper()
+		if _, err := s.Put(ctx, key, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+		info, err := s.Stat(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	replace := func(key string, old *ObjectInfo, content string) error {
+		_, err := s.Replace(ctx, key, old, strings.NewReader(content), int64(len(content)))
+		return err
+	}
+
+	old := put("r/a.txt", "first")
+	if err := replace("r/a.txt", old, "second"); err != nil {
+		t.Fatalf("replace of an unchanged object = %v", err)
+	}
+	if err := replace("r/a.txt", old, "third"); err != ErrChanged {
+		t.Errorf("replace of a replaced object = %v, want ErrChanged", err)
+	}
+
+	// A deleted or moved object never comes back
+	old = put("r/b.txt", "content")
+	s.Delete(ctx, "r/b.txt")
+	if err := replace("r/b.txt", old, "content"); err != ErrChanged {
+		t.Errorf("replace of a deleted object = %v, want ErrChanged", err)
+	}
+	old = put("r/c.txt", "content")
+	s.Move(ctx, "r/c.txt", "r/d.txt")
+	if err := replace("r/c.txt", old, "content"); err != ErrChanged {
+		t.Errorf("replace of a moved object = %v, want ErrChanged", err)
+	}
+	if _, err := s.Stat(ctx, "r/c.txt"); err != ErrNotExist {
+		t.Errorf("stat of a moved object after its replace = %v, want ErrNotExist", err)
+	}
+
+	s.Delete(ctx, "r")
+}
+
+func TestLocal(t *testing.T) {
+	s, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+	testReplace(t, s)
+}
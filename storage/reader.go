@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ReadSeeker reads an object with ranged gets, so it can be served with
+// http.ServeContent without downloading what the client didn't ask for
+type ReadSeeker struct {
+	ctx    context.Context
+	s      Storage
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func NewReadSeeker(ctx context.Context, s Storage, key string, size int64) *ReadSeeker {
+	return &ReadSeeker{ctx: ctx, s: s, key: key, size: size}
+}
+
+func (r *ReadSeeker) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		body, err := r.s.Get(r.ctx, r.key, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *ReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("storage: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("storage: negative position")
+	}
+
+	// The next read starts a new get at the new offset
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *ReadSeeker) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
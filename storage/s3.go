@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	config "github.com/poriamsz55/distork/configs"
+)
+
+// S3 keeps objects in a bucket of an S3 compatible object storage such as MinIO
+type S3 struct {
+	Client *minio.Client
+	Bucket string
+}
+
+func NewS3(cfg *config.ConfigStorage) (*S3, error) {
+	client, err := minio.New(cfg.S3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.S3AccessKey, cfg.S3SecretKey, ""),
+		Secure: cfg.S3UseSSL,
+		Region: cfg.S3Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the bucket on first start
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, cfg.S3Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		err = client.MakeBucket(ctx, cfg.S3Bucket, minio.MakeBucketOptions{Region: cfg.S3Region})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &S3{Client: client, Bucket: cfg.S3Bucket}, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) (int64, error) {
+	info, err := s.Client.PutObject(ctx, s.Bucket, Key(key), r, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// Replace is a Put conditional on the entity tag of old, the bucket
+// refuses it when the object was changed or deleted meanwhile
+func (s *S3) Replace(ctx context.Context, key string, old *ObjectInfo, r io.Reader, size int64) (int64, error) {
+	if old.ETag == "" {
+		return 0, ErrChanged
+	}
+
+	opts := minio.PutObjectOptions{ContentType: "application/octet-stream"}
+	opts.SetMatchETag(old.ETag)
+	info, err := s.Client.PutObject(ctx, s.Bucket, Key(key), r, size, opts)
+	if err != nil {
+		code := minio.ToErrorResponse(err).Code
+		if code == "PreconditionFailed" || code == "NoSuchKey" || code == "NotFound" {
+			return 0, ErrChanged
+		}
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (s *S3) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if length > 0 {
+		if err := opts.SetRange(offset, offset+length-1); err != nil {
+			return nil, err
+		}
+	} else if offset > 0 {
+		if err := opts.SetRange(offset, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	obj, err := s.Client.GetObject(ctx, s.Bucket, Key(key), opts)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	// GetObject is lazy, Stat makes sure the object exists before reading it
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, s3Error(err)
+	}
+	return obj, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := s.Client.StatObject(ctx, s.Bucket, Key(key), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return &ObjectInfo{Key: info.Key, Size: info.Size, ModTime: info.LastModified, ETag: info.ETag}, nil
+}
+
+func (s *S3) List(ctx context.Context, key string) ([]ObjectInfo, error) {
+	key = Key(key)
+	objects := []ObjectInfo{}
+	for obj := range s.Client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{Prefix: key, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		// the prefix "docs" also matches "docs2/a.txt"
+		if !inTree(key, obj.Key) {
+			continue
+		}
+		objects = append(objects, ObjectInfo{Key: obj.Key, Size: obj.Size, ModTime: obj.LastModified, ETag: obj.ETag})
+	}
+	return objects, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	objects, err := s.List(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	objectsCh := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(objectsCh)
+		for _, obj := range objects {
+			objectsCh <- minio.ObjectInfo{Key: obj.Key}
+		}
+	}()
+
+	for removeErr := range s.Client.RemoveObjects(ctx, s.Bucket, objectsCh, minio.RemoveObjectsOptions{}) {
+		if removeErr.Err != nil {
+			return removeErr.Err
+		}
+	}
+	return nil
+}
+
+func (s *S3) Move(ctx context.Context, src, dst string) error {
+	src, dst = Key(src), Key(dst)
+	objects, err := s.List(ctx, src)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return ErrNotExist
+	}
+
+	// Object storage has no rename, copy every object then remove the originals.
+	// ComposeObject copies in parts so objects over 5 GB work too.
+	for _, obj := range objects {
+		_, err := s.Client.ComposeObject(ctx,
+			minio.CopyDestOptions{Bucket: s.Bucket, Object: dst + strings.TrimPrefix(obj.Key, src)},
+			minio.CopySrcOptions{Bucket: s.Bucket, Object: obj.Key})
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.Delete(ctx, src)
+}
+
+// s3Error maps the missing object errors of S3 to ErrNotExist
+func s3Error(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return ErrNotExist
+	}
+	return err
+}
@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	config "github.com/poriamsz55/distork/configs"
+)
+
+// TestS3 needs an S3 compatible server such as MinIO, for example:
+//
+//	DISTORK_S3_TEST_ENDPOINT=localhost:9000 DISTORK_S3_ACCESS_KEY=minioadmin \
+//	DISTORK_S3_SECRET_KEY=minioadmin go test ./storage/
+func TestS3(t *testing.T) {
+	endpoint := os.Getenv("DISTORK_S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DISTORK_S3_TEST_ENDPOINT is not set")
+	}
+
+	s, err := NewS3(&config.ConfigStorage{
+		S3Endpoint:  endpoint,
+		S3Region:    "us-east-1",
+		S3Bucket:    "distork-test",
+		S3AccessKey: os.Getenv("DISTORK_S3_ACCESS_KEY"),
+		S3SecretKey: os.Getenv("DISTORK_S3_SECRET_KEY"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+	testReplace(t, s)
+}
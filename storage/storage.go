@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	config "github.com/poriamsz55/distork/configs"
+)
+
+// ErrNotExist is returned when no object is stored under a key
+var ErrNotExist = errors.New("storage: object does not exist")
+
+// ErrChanged is returned by Replace when the object was changed, moved or
+// deleted since it was read, it is left as it is
+var ErrChanged = errors.New("storage: object changed")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	ETag    string    `json:"-"` // of S3 objects, empty for local ones
+}
+
+// Storage keeps the bytes of drive files. Keys are slash separated paths such
+// as "uploads/alice/docs/a.txt". Folders only exist as the prefix of the keys
+// stored below them: List, Delete and Move work on a key and its whole tree.
+type Storage interface {
+	// Put stores the content of r under key, size is -1 when it is unknown
+	Put(ctx context.Context, key string, r io.Reader, size int64) (int64, error)
+	// Get reads length bytes of key starting at offset, a negative length reads to the end
+	Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// List returns every object stored under key or below it
+	List(ctx context.Context, key string) ([]ObjectInfo, error)
+	// Delete removes key and every object below it
+	Delete(ctx context.Context, key string) error
+	// Move renames key and every object below it to dst
+	Move(ctx context.Context, src, dst string) error
+}
+
+// Replacer is a Storage that rewrites an object only if it is still the one
+// that was read, so a rewrite never brings back an object deleted or moved
+// in the meantime
+type Replacer interface {
+	// Replace stores the content of r under key like Put, only while the
+	// object is the one described by old. It returns ErrChanged otherwise.
+	Replace(ctx context.Context, key string, old *ObjectInfo, r io.Reader, size int64) (int64, error)
+}
+
+var (
+	defaultStorage Storage
+	initOnce       sync.Once
+	initErr        error
+)
+
+// Init creates the storage selected in the configuration
+func Init() error {
+	initOnce.Do(func() {
+		cfg := config.GetConfigStorage()
+		switch cfg.Driver {
+		case config.StorageLocal:
+			defaultStorage, initErr = NewLocal(cfg.LocalRoot)
+		case config.StorageS3:
+			defaultStorage, initErr = NewS3(cfg)
+		default:
+			initErr = fmt.Errorf("storage: unknown driver %q", cfg.Driver)
+		}
+		if initErr != nil || cfg.EncryptionKeys == "" {
+			return
+		}
+
+		// Encryption wraps whichever driver was chosen
+		keys, err := ParseMasterKeys(cfg.EncryptionKeys)
+		if err != nil {
+			initErr = err
+			return
+		}
+		defaultStorage, initErr = NewEncrypted(defaultStorage, keys)
+	})
+	return initErr
+}
+
+// GetStorage returns the storage of the drive, Init must have succeeded
+func GetStorage() Storage {
+	if defaultStorage == nil {
+		panic("storage not initialized. Call Init first.")
+	}
+	return defaultStorage
+}
+
+// Key joins elements into a storage key, ".." can never climb above the first one
+func Key(elem ...string) string {
+	for i := range elem {
+		elem[i] = strings.Trim(path.Clean("/"+elem[i]), "/")
+	}
+	return strings.Trim(path.Join(elem...), "/")
+}
+
+// Copy copies key and every object below it to dst and returns the bytes copied
+func Copy(ctx context.Context, s Storage, src, dst string) (int64, error) {
+	objects, err := s.List(ctx, src)
+	if err != nil {
+		return 0, err
+	}
+
+	var copied int64
+	for _, obj := range objects {
+		r, err := s.Get(ctx, obj.Key, 0, -1)
+		if err != nil {
+			return copied, err
+		}
+		n, err := s.Put(ctx, dst+strings.TrimPrefix(obj.Key, src), r, obj.Size)
+		r.Close()
+		if err != nil {
+			return copied, err
+		}
+		copied += n
+	}
+	return copied, nil
+}
+
+// inTree reports whether key is root or stored below it
+func inTree(root, key string) bool {
+	return key == root || root == "" || strings.HasPrefix(key, root+"/")
+}
@@ -2,10 +2,24 @@ package utils
 
 import (
 	"fmt"
+	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
+
+	config "github.com/poriamsz55/distork/configs"
 )
 
+// ChunkPartPattern matches the parts written by chunked uploads: name.part-N-timestamp
+const ChunkPartPattern = `\.part-\d+-[^/]+$`
+
+var chunkPartPattern = regexp.MustCompile(ChunkPartPattern)
+
+// IsChunkPart reports whether name is a part of an unfinished chunked upload
+func IsChunkPart(name string) bool {
+	return chunkPartPattern.MatchString(name)
+}
+
 func SanitizeFileName(fileName string, copyCount int) string {
 	extension := filepath.Ext(fileName)
 	name := strings.TrimSuffix(filepath.Base(fileName), extension)
@@ -15,3 +29,62 @@ func SanitizeFileName(fileName string, copyCount int) string {
 	}
 	return fmt.Sprintf("%s (%d)%s", name, copyCount, extension)
 }
+
+// CleanDrivePath normalizes a user supplied drive path to the "/a/b" form
+// used in the files collection. ".." elements can never climb above "/".
+func CleanDrivePath(p string) string {
+	return path.Clean("/" + filepath.ToSlash(p))
+}
+
+// DriveKey returns the storage key of a drive path inside the user's upload directory
+func DriveKey(username, p string) string {
+	return path.Join(config.GetConfigDrive().UploadDir, username, CleanDrivePath(p))
+}
+
+// NamePattern turns a name search into a regular expression: a glob when it
+// holds *, ? or [...], a substring anywhere in the name otherwise. A [ that
+// opens no class, unclosed or empty, matches itself. A class the regular
+// expression can't hold, like [z-a], is an error.
+// Matching is meant to be case insensitive.
+func NamePattern(search string) (string, error) {
+	if !strings.ContainsAny(search, "*?[") {
+		return regexp.QuoteMeta(search), nil
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(search); i++ {
+		switch ch := search[i]; ch {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(search[i+1:], ']')
+			class := search[i+1 : i+1+max(end, 0)]
+			negated := strings.HasPrefix(class, "!")
+			if negated {
+				class = class[1:]
+			}
+			if end < 0 || class == "" {
+				b.WriteString(`\[`)
+				continue
+			}
+			i += end + 1
+			b.WriteString("[")
+			if negated {
+				b.WriteString("^")
+			}
+			b.WriteString(strings.ReplaceAll(class, `\`, `\\`) + "]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	b.WriteString("$")
+
+	pattern := b.String()
+	if _, err := regexp.Compile(pattern); err != nil {
+		return "", fmt.Errorf("invalid name pattern %q", search)
+	}
+	return pattern, nil
+}
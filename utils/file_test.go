@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestCleanDrivePath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "empty", path: "", want: "/"},
+		{name: "dot", path: ".", want: "/"},
+		{name: "relative", path: "docs/a.txt", want: "/docs/a.txt"},
+		{name: "trailing slash", path: "/docs/", want: "/docs"},
+		{name: "parent", path: "docs/../a.txt", want: "/a.txt"},
+		{name: "escape", path: "../../etc/passwd", want: "/etc/passwd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CleanDrivePath(tt.path); got != tt.want {
+				t.Errorf("CleanDrivePath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamePattern(t *testing.T) {
+	tests := []struct {
+		search string
+		name   string
+		want   bool
+	}{
+		{search: "report", name: "Q3 report.pdf", want: true},
+		{search: "a.b", name: "axb", want: false},
+		{search: "*.jpg", name: "cat.jpg", want: true},
+		{search: "*.jpg", name: "cat.jpg.txt", want: false},
+		{search: "img_??.png", name: "img_01.png", want: true},
+		{search: "img_??.png", name: "img_1.png", want: false},
+		{search: "[ab]*", name: "beta", want: true},
+		{search: "[!ab]*", name: "beta", want: false},
+		{search: "[unclosed*", name: "[unclosed file", want: true},
+		{search: "[]*", name: "[] notes", want: true},
+		{search: "[]*", name: "notes", want: false},
+		{search: "a[!]b", name: "a[!]b", want: true},
+		{search: "[!]", name: "x", want: false},
+	}
+	for _, tt := range tests {
+		pattern, err := NamePattern(tt.search)
+		if err != nil {
+			t.Errorf("NamePattern(%q): %v", tt.search, err)
+			continue
+		}
+		re := regexp.MustCompile("(?i)" + pattern)
+		if got := re.MatchString(tt.name); got != tt.want {
+			t.Errorf("NamePattern(%q) matches %q = %v, want %v", tt.search, tt.name, got, tt.want)
+		}
+	}
+
+	for _, search := range []string{"[z-a]", "[!z-a]*", "[[:nope:]]"} {
+		if pattern, err := NamePattern(search); err == nil {
+			t.Errorf("NamePattern(%q) = %q, want an error", search, pattern)
+		}
+	}
+}
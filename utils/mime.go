@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// MimeSniffLen is how many bytes of the content DetectMimeType looks at
+const MimeSniffLen = 512
+
+// DetectMimeType returns the media type of a file from the first bytes of its
+// content and the extension of its name. The content wins when it has a known
+// signature, the extension refines the generic types sniffing falls back to,
+// e.g. text/plain for CSS or application/zip for DOCX. head may be empty when
+// the content is not at hand.
+func DetectMimeType(name string, head []byte) string {
+	byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	if len(head) == 0 {
+		if byExt == "" {
+			return "application/octet-stream"
+		}
+		return byExt
+	}
+
+	sniffed := http.DetectContentType(head)
+	base := BaseMimeType(sniffed)
+	if byExt != "" && (base == "application/octet-stream" || base == "text/plain" || base == "application/zip") {
+		return byExt
+	}
+	return sniffed
+}
+
+// BaseMimeType returns a media type without its parameters, in lower case
+func BaseMimeType(mimeType string) string {
+	base, _, _ := strings.Cut(mimeType, ";")
+	return strings.ToLower(strings.TrimSpace(base))
+}
+
+// IsInlineSafe reports whether content of the media type can be shown in the
+// browser. HTML, SVG and anything else that can run scripts is never safe.
+func IsInlineSafe(mimeType string) bool {
+	base := BaseMimeType(mimeType)
+	switch {
+	case base == "image/svg+xml":
+		return false
+	case base == "application/pdf", base == "text/plain":
+		return true
+	case strings.HasPrefix(base, "image/"), strings.HasPrefix(base, "audio/"), strings.HasPrefix(base, "video/"):
+		return true
+	}
+	return false
+}
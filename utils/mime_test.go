@@ -0,0 +1,46 @@
+package utils
+
+import "testing"
+
+func TestDetectMimeType(t *testing.T) {
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+	tests := []struct {
+		name     string
+		filename string
+		head     []byte
+		want     string
+	}{
+		{name: "signature", filename: "a.png", head: png, want: "image/png"},
+		{name: "signature beats extension", filename: "a.txt", head: png, want: "image/png"},
+		{name: "html named as image", filename: "a.jpg", head: []byte("<html><script>"), want: "text/html; charset=utf-8"},
+		{name: "extension refines text", filename: "a.css", head: []byte("body { color: red }"), want: "text/css; charset=utf-8"},
+		{name: "no content", filename: "a.pdf", want: "application/pdf"},
+		{name: "unknown", filename: "a", head: []byte{0, 1, 2}, want: "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectMimeType(tt.filename, tt.head); got != tt.want {
+				t.Errorf("DetectMimeType(%q) = %q, want %q", tt.filename, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsInlineSafe(t *testing.T) {
+	tests := map[string]bool{
+		"image/png":                 true,
+		"video/mp4":                 true,
+		"audio/mpeg":                true,
+		"application/pdf":           true,
+		"text/plain; charset=utf-8": true,
+		"image/svg+xml":             false,
+		"text/html; charset=utf-8":  false,
+		"application/javascript":    false,
+		"text/xml; charset=utf-8":   false,
+	}
+	for mimeType, want := range tests {
+		if got := IsInlineSafe(mimeType); got != want {
+			t.Errorf("IsInlineSafe(%q) = %v, want %v", mimeType, got, want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+
+	// Formats image.Decode understands
+	_ "image/gif"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+// MaxThumbnailPixels is the largest image, in pixels, thumbnails are made of.
+// Decoding allocates for every pixel, so bigger images are refused up front.
+const MaxThumbnailPixels = 50 * 1000 * 1000
+
+// thumbnailHeaderSize is how much of an image is read to find its dimensions,
+// enough for the metadata segments cameras put before them
+const thumbnailHeaderSize = 1024 * 1024
+
+var thumbnailExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true}
+
+// IsImageName reports whether a file name has the extension of an image thumbnails are made of
+func IsImageName(name string) bool {
+	return thumbnailExts[strings.ToLower(filepath.Ext(name))]
+}
+
+// MakeThumbnail decodes a JPEG, PNG, GIF or WebP image and returns a JPEG
+// fitting in a size x size square. Smaller images are not enlarged and
+// transparent parts are drawn over white.
+func MakeThumbnail(r io.Reader, size int) ([]byte, error) {
+	br := bufio.NewReaderSize(r, thumbnailHeaderSize)
+
+	// Check the dimensions from the header before decoding the pixels
+	header, err := br.Peek(thumbnailHeaderSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(header))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > MaxThumbnailPixels {
+		return nil, errors.New("image is too large for a thumbnail")
+	}
+
+	src, _, err := image.Decode(br)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width >= height {
+			width, height = size, max(height*size/width, 1)
+		} else {
+			width, height = max(width*size/height, 1), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestMakeThumbnail(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		size          int
+		wantW, wantH  int
+	}{
+		{name: "landscape", width: 400, height: 200, size: 128, wantW: 128, wantH: 64},
+		{name: "portrait", width: 200, height: 400, size: 128, wantW: 64, wantH: 128},
+		{name: "small", width: 50, height: 30, size: 128, wantW: 50, wantH: 30},
+		{name: "thin", width: 1000, height: 1, size: 128, wantW: 128, wantH: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var src bytes.Buffer
+			if err := png.Encode(&src, image.NewNRGBA(image.Rect(0, 0, tt.width, tt.height))); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := MakeThumbnail(&src, tt.size)
+			if err != nil {
+				t.Fatalf("MakeThumbnail() error = %v", err)
+			}
+			cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("thumbnail is not a JPEG: %v", err)
+			}
+			if cfg.Width != tt.wantW || cfg.Height != tt.wantH {
+				t.Errorf("thumbnail is %dx%d, want %dx%d", cfg.Width, cfg.Height, tt.wantW, tt.wantH)
+			}
+		})
+	}
+
+	if _, err := MakeThumbnail(bytes.NewReader([]byte("not an image")), 128); err == nil {
+		t.Error("MakeThumbnail() of text succeeded")
+	}
+}